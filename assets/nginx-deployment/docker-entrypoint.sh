@@ -2,5 +2,5 @@
 
 nginx &
 
-/go/bin/paas-server --addr localhost:1024 --nginx
+exec /go/bin/paas-server --addr localhost:1024 --ingress nginx
 
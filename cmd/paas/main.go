@@ -2,7 +2,13 @@ package main
 
 import (
 	"container-paas/internal"
+	"context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -17,13 +23,90 @@ func main() {
 		NotFound: internal.G.Logger.LogRequests(&internal.NotFoundHandler{}),
 	}
 
-	mux.Handle("/admin/[a-zA-Z0-9_-]+", internal.G.Logger.LogRequests(&internal.AdminHandler{}))
+	mux.HandleHost(internal.AppHostHandler{}, internal.G.Logger.LogRequests(internal.AppHostHandler{}))
+	admin := internal.G.Logger.LogRequests(internal.G.AdminAuth.Authenticate(&internal.AdminHandler{}))
+	mux.HandleServer("^/admin/?$", admin)
+	mux.HandleServer("^/admin/audit$", internal.G.Logger.LogRequests(internal.G.AdminAuth.Authenticate(&internal.AuditHandler{})))
+	mux.HandleServer("^/admin/secrets(/[a-zA-Z0-9_.-]*)?$", internal.G.Logger.LogRequests(internal.G.AdminAuth.Authenticate(&internal.SecretsHandler{})))
+	mux.HandleServer("^/admin/[a-zA-Z0-9_-]+/keys(/[a-zA-Z0-9_-]+)?$", internal.G.Logger.LogRequests(internal.G.AdminAuth.Authenticate(&internal.AppKeysHandler{})))
+	mux.HandleServer("^/admin/", admin)
 	mux.Handle("/app/[a-zA-Z0-9_-]+", internal.G.Logger.LogRequests(&internal.AppHandler{}))
 
+	if internal.G.AdminAuth.Insecure {
+		internal.G.Logger.Warning("Admin authentication is disabled, anyone who can reach the server can manage apps")
+	} else if !internal.G.AdminAuth.Configured() {
+		internal.G.Logger.Warning("No admin tokens or keys are configured, every admin request will be rejected")
+	}
+
+	// h2c allows gRPC clients to reach apps without TLS
+	var handler http.Handler = h2c.NewHandler(mux, &http2.Server{IdleTimeout: internal.G.IdleTimeout})
+	if internal.G.TLSRedirect && internal.G.Certs.Enabled() {
+		handler = internal.RedirectHTTPS{TLSAddr: internal.G.TLSAddr}
+	}
+	// ACME challenges must be answered before host routing could send them to an app
+	handler = internal.G.Certs.HTTPHandler(handler)
+
 	internal.G.Logger.Info("Listening for requests on " + internal.G.Addr)
-	err = http.ListenAndServe(internal.G.Addr, mux)
-	if err != nil {
+	server := newServer(internal.G.Addr, handler)
+	servers := []*http.Server{server}
+
+	serveErr := make(chan error, 3)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	if internal.G.ACMEHTTPAddr != "" {
+		// Only answers challenges, and redirects every other request to HTTPS
+		internal.G.Logger.Info("Listening for ACME challenges on " + internal.G.ACMEHTTPAddr)
+		challengeServer := newServer(internal.G.ACMEHTTPAddr, internal.G.Certs.HTTPHandler(nil))
+		servers = append(servers, challengeServer)
+
+		go func() {
+			serveErr <- challengeServer.ListenAndServe()
+		}()
+	}
+
+	if internal.G.Certs.Enabled() {
+		internal.G.Logger.Info("Listening for TLS requests on " + internal.G.TLSAddr)
+		tlsServer := newServer(internal.G.TLSAddr, mux)
+		tlsServer.TLSConfig = internal.G.Certs.TLSConfig()
+		if err = http2.ConfigureServer(tlsServer, &http2.Server{IdleTimeout: internal.G.IdleTimeout}); err != nil {
+			panic(err)
+		}
+		servers = append(servers, tlsServer)
+
+		go func() {
+			serveErr <- tlsServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-serveErr:
 		panic(err)
+	case sig := <-signals:
+		internal.G.Logger.Info("Received " + sig.String() + ", shutting down")
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), internal.G.DrainTimeout)
+	defer cancel()
+	if err = internal.Shutdown(ctx, servers...); err != nil {
+		internal.G.Logger.LogError(err)
+	}
+
+	internal.G.Logger.Info("Shutdown complete")
+}
+
+// Creates a server using the configured connection timeouts
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       internal.G.ReadTimeout,
+		ReadHeaderTimeout: internal.G.ReadHeaderTimeout,
+		WriteTimeout:      internal.G.WriteTimeout,
+		IdleTimeout:       internal.G.IdleTimeout,
+	}
 }
@@ -0,0 +1,107 @@
+package internal
+
+// acme.go
+// Certificates for app domains obtained and renewed through ACME, such as from Let's Encrypt.
+// The HTTP-01 challenge is answered by the plain HTTP listener, and by the listener on
+// -acme-http-addr when the plain listener isn't reachable on port 80. Certificates are cached
+// in a directory so they survive restarts. Certificates are only requested for the custom
+// domains of apps, <id>.<domain> for apps under -app-domain, and hosts listed in -acme-hosts.
+// A custom CA root can be trusted for the ACME directory, so a local CA such as Pebble works
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Creates the ACME manager for a directory URL, caching certificates and the account key in
+// cacheDir. caRootFile optionally names PEM certificates trusted when connecting to the directory
+func NewACMEManager(directoryURL, cacheDir, email, caRootFile string, hosts []string) (*autocert.Manager, error) {
+	if cacheDir == "" {
+		return nil, errors.New("ACME requires a directory to store certificates in")
+	}
+
+	client := &acme.Client{DirectoryURL: directoryURL}
+
+	if caRootFile != "" {
+		pem, err := ioutil.ReadFile(caRootFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caRootFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if host = normalizeHost(host); host != "" {
+			allowed[host] = true
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		Client: client,
+		Email:  email,
+		HostPolicy: func(_ context.Context, host string) error {
+			if allowed[host] {
+				return nil
+			}
+			if _, ok := appForHost(host); ok {
+				return nil
+			}
+			return errors.New("No app is served at " + host)
+		},
+	}, nil
+}
+
+// Splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Requests certificates for the app's custom domains in the background, so the first
+// client doesn't have to wait for the certificate to be issued
+func (s *CertStore) Prefetch(app *App) {
+	if s.acme == nil {
+		return
+	}
+	for _, domain := range app.Domains {
+		go func(domain string) {
+			if _, err := s.acme.GetCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+				G.Logger.Warning("Could not obtain a certificate for " + domain + ": " + err.Error())
+				return
+			}
+			G.Logger.Info("Obtained a certificate for " + domain)
+		}(domain)
+	}
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges, passing every other request to next. A nil
+// next redirects every other request to HTTPS
+func (s *CertStore) HTTPHandler(next http.Handler) http.Handler {
+	if s.acme == nil {
+		return next
+	}
+	return s.acme.HTTPHandler(next)
+}
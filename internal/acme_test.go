@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockACME is a minimal ACME directory issuing certificates for a single order. HTTP-01
+// challenges are validated by fetching the token from challengeAddr with the domain as
+// the Host header, as a CA would after resolving the domain. Signatures aren't checked
+type mockACME struct {
+	t             *testing.T
+	srv           *httptest.Server
+	challengeAddr string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	thumbprint string // Of the account key
+	domain     string
+	token      string
+	authzValid bool
+	cert       []byte // PEM chain, once the order is finalized
+	validated  int    // Challenge responses fetched
+}
+
+func newMockACME(t *testing.T) *mockACME {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	m := &mockACME{t: t, caKey: key, caCert: cert, token: "token-1"}
+	m.srv = httptest.NewServer(m)
+	return m
+}
+
+// Decodes the payload of a JWS request, and the account key from its protected header if present
+func (m *mockACME) payload(r *http.Request, out interface{}) {
+	body := &struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		m.t.Errorf("invalid JWS for %s: %v", r.URL.Path, err)
+		return
+	}
+
+	protected, _ := base64.RawURLEncoding.DecodeString(body.Protected)
+	header := &struct {
+		JWK *jwk `json:"jwk"`
+	}{}
+	_ = json.Unmarshal(protected, header)
+	if header.JWK != nil {
+		key, err := parseJWK(header.JWK)
+		if err != nil {
+			m.t.Errorf("invalid account key: %v", err)
+			return
+		}
+		if m.thumbprint, err = acme.JWKThumbprint(key); err != nil {
+			m.t.Error(err)
+		}
+	}
+
+	if b, _ := base64.RawURLEncoding.DecodeString(body.Payload); len(b) > 0 && out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			m.t.Errorf("invalid payload for %s: %v", r.URL.Path, err)
+		}
+	}
+}
+
+func (m *mockACME) order() map[string]interface{} {
+	status := "pending"
+	if m.cert != nil {
+		status = "valid"
+	} else if m.authzValid {
+		status = "ready"
+	}
+	return map[string]interface{}{
+		"status":         status,
+		"identifiers":    []interface{}{map[string]string{"type": "dns", "value": m.domain}},
+		"authorizations": []string{m.srv.URL + "/authz/1"},
+		"finalize":       m.srv.URL + "/finalize/1",
+		"certificate":    m.srv.URL + "/cert/1",
+	}
+}
+
+// Fetches the challenge response from the challenge listener, like a CA validating HTTP-01
+func (m *mockACME) validate() bool {
+	req, _ := http.NewRequest("GET", "http://"+m.challengeAddr+"/.well-known/acme-challenge/"+m.token, nil)
+	req.Host = m.domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		m.t.Errorf("challenge listener unreachable: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	m.validated++
+	return resp.StatusCode == 200 && string(b) == m.token+"."+m.thumbprint
+}
+
+func (m *mockACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", "nonce-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	respond := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	switch r.URL.Path {
+	case "/directory":
+		respond(200, map[string]string{
+			"newNonce":   m.srv.URL + "/nonce",
+			"newAccount": m.srv.URL + "/account",
+			"newOrder":   m.srv.URL + "/order",
+			"revokeCert": m.srv.URL + "/revoke",
+			"keyChange":  m.srv.URL + "/key-change",
+		})
+	case "/nonce":
+		w.WriteHeader(200)
+	case "/account":
+		m.payload(r, nil)
+		w.Header().Set("Location", m.srv.URL+"/account/1")
+		respond(201, map[string]interface{}{"status": "valid"})
+	case "/order":
+		req := &struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}{}
+		m.payload(r, req)
+		if len(req.Identifiers) == 1 {
+			m.domain = req.Identifiers[0].Value
+		}
+		w.Header().Set("Location", m.srv.URL+"/order/1")
+		respond(201, m.order())
+	case "/order/1":
+		m.payload(r, nil)
+		respond(200, m.order())
+	case "/authz/1":
+		m.payload(r, nil)
+		status := "pending"
+		if m.authzValid {
+			status = "valid"
+		}
+		respond(200, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": m.domain},
+			"challenges": []interface{}{map[string]string{
+				"type": "http-01", "url": m.srv.URL + "/chal/1", "token": m.token, "status": status,
+			}},
+		})
+	case "/chal/1":
+		m.payload(r, nil)
+		if !m.authzValid {
+			m.authzValid = m.validate()
+		}
+		status := "invalid"
+		if m.authzValid {
+			status = "valid"
+		}
+		respond(200, map[string]string{"type": "http-01", "url": m.srv.URL + "/chal/1", "token": m.token, "status": status})
+	case "/finalize/1":
+		req := &struct {
+			CSR string `json:"csr"`
+		}{}
+		m.payload(r, req)
+		m.issue(req.CSR)
+		w.Header().Set("Location", m.srv.URL+"/order/1")
+		respond(200, m.order())
+	case "/cert/1":
+		m.payload(r, nil)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(m.cert)
+	default:
+		respond(404, map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": "not found"})
+	}
+}
+
+// Signs the CSR once the authorization is valid
+func (m *mockACME) issue(b64CSR string) {
+	if !m.authzValid {
+		return
+	}
+	der, _ := base64.RawURLEncoding.DecodeString(b64CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		m.t.Errorf("invalid CSR: %v", err)
+		return
+	}
+	// Like real CAs, the names come from the order, whatever the CSR lists
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: m.domain},
+		DNSNames:     []string{m.domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, m.caCert, csr.PublicKey, m.caKey)
+	if err != nil {
+		m.t.Error(err)
+		return
+	}
+	m.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw})...)
+}
+
+// Obtains a certificate with the HTTP-01 challenge answered by a listener other than the
+// server's main one, like the one opened on -acme-http-addr
+func TestACMEChallengeListener(t *testing.T) {
+	testGlobal(t)
+
+	ca := newMockACME(t)
+	defer ca.srv.Close()
+
+	manager, err := NewACMEManager(ca.srv.URL+"/directory", t.TempDir(), "", "", []string{"paas.example.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := NewCertStore("", "", "", manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenges := httptest.NewServer(certs.HTTPHandler(nil))
+	defer challenges.Close()
+	ca.challengeAddr = strings.TrimPrefix(challenges.URL, "http://")
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "paas.example.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.validated == 0 {
+		t.Error("the challenge was never fetched from the challenge listener")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("paas.example.test"); err != nil {
+		t.Error(err)
+	}
+
+	// Hosts which aren't served are refused before contacting the CA
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.test"}); err == nil {
+		t.Error("obtained a certificate for a host which isn't served")
+	}
+
+	// Anything other than a challenge is redirected to HTTPS
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, _ := http.NewRequest("GET", challenges.URL+"/admin", nil)
+	req.Host = "paas.example.test"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 302 || resp.Header.Get("Location") != "https://paas.example.test/admin" {
+		t.Errorf("non-challenge request got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
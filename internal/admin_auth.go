@@ -0,0 +1,308 @@
+package internal
+
+// admin_auth.go
+// Bearer token authentication for the admin routes. Two kinds of tokens are accepted:
+//
+//   - Static tokens, listed as name:token[:role], one per line in a token file or comma-separated
+//     in the ADMIN_TOKENS environment variable. The name identifies the caller
+//   - HMAC-signed tokens of the form v1.<payload>.<signature>, where the payload is base64url
+//     encoded json like {"sub":"name","role":"owner","exp":1700000000} and the signature is the
+//     base64url encoded HMAC-SHA256 of "v1.<payload>" using one of the configured keys
+//
+// The role is one of admin, owner, or viewer, and defaults to viewer
+//
+// The token and key files are re-read whenever they change, so credentials can be rotated
+// without restarting the server. Listing both the old and new key during a rotation keeps
+// tokens signed with either valid
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoToken      = errors.New("Missing bearer token")
+	errInvalidToken = errors.New("Invalid token")
+	errTokenExpired = errors.New("Token expired")
+	errAuthDisabled = errors.New("Admin authentication is not configured")
+)
+
+// Principal is the authenticated caller of an admin route
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type principalKey struct{}
+
+// Returns the principal authenticated for this request, if any
+func PrincipalFromRequest(r *http.Request) (*Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// AdminAuth holds the credentials accepted by the admin routes
+type AdminAuth struct {
+	Insecure bool // Accept every request without a token
+
+	envTokens map[string]*Principal
+	envKeys   [][]byte
+
+	tokens *watchedFile
+	keys   *watchedFile
+
+	mu         sync.RWMutex
+	fileTokens map[string]*Principal
+	fileKeys   [][]byte
+}
+
+// watchedFile remembers when a file was last read so it is only parsed again after changing
+type watchedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// Re-reads the file if it changed since the last call. Returns nil content when nothing changed
+func (f *watchedFile) changed() ([]byte, bool, error) {
+	if f == nil || f.path == "" {
+		return nil, false, nil
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil, false, nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return b, true, nil
+}
+
+// Creates the admin authentication from a token file, a key file, and the contents of the
+// ADMIN_TOKENS and ADMIN_HMAC_KEYS environment variables. Any of them may be empty
+func NewAdminAuth(tokenFile, keyFile, envTokens, envKeys string, insecure bool) (*AdminAuth, error) {
+	tokens, err := parseTokens(strings.Split(envTokens, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AdminAuth{
+		Insecure:   insecure,
+		envTokens:  tokens,
+		envKeys:    parseKeys(strings.Split(envKeys, ",")),
+		tokens:     &watchedFile{path: tokenFile},
+		keys:       &watchedFile{path: keyFile},
+		fileTokens: make(map[string]*Principal),
+	}
+
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Hashing the tokens avoids comparing secrets byte by byte when looking them up
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Parses name:token[:role] entries. Blank entries and lines starting with # are skipped
+func parseTokens(entries []string) (map[string]*Principal, error) {
+	tokens := make(map[string]*Principal)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("Invalid admin token entry, expected name:token[:role]")
+		}
+		role := ""
+		if len(parts) == 3 {
+			role = parts[2]
+		}
+		r, err := parseRole(role)
+		if err != nil {
+			return nil, err
+		}
+		tokens[hashToken(parts[1])] = &Principal{Name: parts[0], Role: r}
+	}
+	return tokens, nil
+}
+
+func parseKeys(entries []string) [][]byte {
+	var keys [][]byte
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		keys = append(keys, []byte(entry))
+	}
+	return keys
+}
+
+// Reads the token and key files again if they changed since they were last read.
+// If a file can't be parsed the previous credentials are kept
+func (a *AdminAuth) reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if b, ok, err := a.tokens.changed(); err != nil {
+		return err
+	} else if ok {
+		tokens, err := parseTokens(strings.Split(string(b), "\n"))
+		if err != nil {
+			return err
+		}
+		a.fileTokens = tokens
+	}
+
+	if b, ok, err := a.keys.changed(); err != nil {
+		return err
+	} else if ok {
+		a.fileKeys = parseKeys(strings.Split(string(b), "\n"))
+	}
+
+	return nil
+}
+
+// Configured indicates whether any tokens or keys are available. Without them every admin request is rejected
+func (a *AdminAuth) Configured() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.envTokens) > 0 || len(a.envKeys) > 0 || len(a.fileTokens) > 0 || len(a.fileKeys) > 0
+}
+
+// Finds the principal for a token
+func (a *AdminAuth) authenticate(token string) (*Principal, error) {
+	if err := a.reload(); err != nil {
+		// Keep serving with the last good credentials
+		G.Logger.LogError(err)
+	}
+
+	if !a.Configured() {
+		return nil, errAuthDisabled
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	hash := hashToken(token)
+	if p, ok := a.envTokens[hash]; ok {
+		return p, nil
+	}
+	if p, ok := a.fileTokens[hash]; ok {
+		return p, nil
+	}
+
+	return verifySignedToken(token, append(append([][]byte{}, a.envKeys...), a.fileKeys...))
+}
+
+type signedTokenPayload struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"` // Unix time. 0 means the token doesn't expire
+}
+
+// Checks a v1.<payload>.<signature> token against each key
+func verifySignedToken(token string, keys [][]byte) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	valid := false
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	payload := &signedTokenPayload{}
+	if err := json.Unmarshal(b, payload); err != nil || payload.Subject == "" {
+		return nil, errInvalidToken
+	}
+	if payload.Expires != 0 && time.Now().Unix() >= payload.Expires {
+		return nil, errTokenExpired
+	}
+
+	role, err := parseRole(payload.Role)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	return &Principal{Name: payload.Subject, Role: role}, nil
+}
+
+// Returns the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || strings.ToLower(h[:len(prefix)]) != prefix {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// Authenticate is middleware which rejects requests without a valid bearer token with a 401.
+// The principal is added to the request context for the next handler
+func (a *AdminAuth) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.Insecure {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Name: "anonymous", Role: RoleAdmin})))
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			ErrorResponse(w, errNoToken.Error(), 401)
+			return
+		}
+
+		principal, err := a.authenticate(token)
+		if err != nil {
+			G.Logger.Warning("Admin authentication failed from " + clientIP(r) + ": " + err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin", error="invalid_token"`)
+			ErrorResponse(w, err.Error(), 401)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+// Signs a payload the way tools/mint_admin_token.sh does
+func signToken(key []byte, payload string) string {
+	body := "v1." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTokenRoles(t *testing.T) {
+	key := []byte("secret")
+
+	tests := []struct {
+		name    string
+		signed  string // Signed token payload, if the token is signed
+		static  string // Static token entry, otherwise
+		want    Role
+		wantErr bool
+	}{
+		{"signed without role", `{"sub":"ci"}`, "", RoleViewer, false},
+		{"signed empty role", `{"sub":"ci","role":""}`, "", RoleViewer, false},
+		{"signed admin", `{"sub":"ci","role":"admin"}`, "", RoleAdmin, false},
+		{"signed owner", `{"sub":"ci","role":"owner"}`, "", RoleOwner, false},
+		{"signed unknown role", `{"sub":"ci","role":"root"}`, "", "", true},
+		{"static without role", "", "ci:token", RoleViewer, false},
+		{"static admin", "", "ci:token:admin", RoleAdmin, false},
+		{"static unknown role", "", "ci:token:root", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var principal *Principal
+			var err error
+			if tt.signed != "" {
+				principal, err = verifySignedToken(signToken(key, tt.signed), [][]byte{key})
+			} else {
+				var tokens map[string]*Principal
+				if tokens, err = parseTokens([]string{tt.static}); err == nil {
+					principal = tokens[hashToken("token")]
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && principal.Role != tt.want {
+				t.Errorf("role = %q, want %q", principal.Role, tt.want)
+			}
+		})
+	}
+}
@@ -7,14 +7,24 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type AdminHandler struct{}
 
+// IDs which can't be used for apps since other admin routes use them
+var reservedAppIDs = map[string]bool{
+	"secrets": true,
+	"audit":   true,
+}
+
 // Splits actions based on the HTTP method
 // Each method will use a different function since there is little shared
 // functionality between the intended action of verbs
@@ -23,24 +33,59 @@ func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		h.get(w, r)
 	case "POST":
-		h.post(w, r)
+		G.Audit.audit(w, r, appAuditTarget("app.deploy", r, true), h.post)
 	case "DELETE":
-		h.delete(w, r)
+		G.Audit.audit(w, r, appAuditTarget("app.delete", r, false), h.delete)
 	default:
 		ErrorResponse(w, "HTTP Method not supported", 400)
 	}
 }
 
+// Audit target for a mutating request on the app in the route
+func appAuditTarget(action string, r *http.Request, request bool) auditTarget {
+	id, _ := trimPath("/admin/", r)
+	return auditTarget{
+		action: action,
+		appID:  id,
+		snapshot: func() interface{} {
+			app, _ := G.AppMgr.Get(id)
+			return app
+		},
+		request: request,
+	}
+}
+
+// Returns the principal authenticated by AdminAuth. The admin routes are always wrapped
+// in AdminAuth.Authenticate, so a missing principal means the request is rejected
+func adminPrincipal(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	p, ok := PrincipalFromRequest(r)
+	if !ok {
+		ErrorResponse(w, "Unauthorized", 401)
+	}
+	return p, ok
+}
+
 // Get information about a specific app, based on the id passed in the route
 // If the app does not exist, a 404 message is returned along with a readable message
-func (AdminHandler) get(w http.ResponseWriter, r *http.Request) {
+// Without an id, every app visible to the caller is listed
+func (h AdminHandler) get(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
+
 	id, err := trimPath("/admin/", r)
-	if err != nil {
-		BasicResponse(w, "Resource not found", 404)
+	if err != nil || id == "" {
+		h.list(w, r, principal)
 		return
 	}
 
 	if app, ok := G.AppMgr.Get(id); ok {
+		if !principal.CanRead(app) {
+			ErrorResponse(w, "Not allowed to view this app", 403)
+			return
+		}
+
 		b, err := json.Marshal(app)
 		if err != nil {
 			G.Logger.LogError(err)
@@ -56,11 +101,69 @@ func (AdminHandler) get(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Lists the apps the principal can read, sorted by id
+func (AdminHandler) list(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	apps := make([]*App, 0)
+	for _, app := range G.AppMgr.List() {
+		if principal.CanRead(app) {
+			apps = append(apps, app)
+		}
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ID < apps[j].ID })
+
+	b, err := json.Marshal(apps)
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(b)
+}
+
 type containerPostRequest struct {
 	Image string   `json:"image"`
 	Cmd   string   `json:"cmd"`
 	Dir   string   `json:"dir"`
 	Env   []string `json:"env"`
+
+	// Mount dir read-only
+	ReadOnlyDir bool `json:"readOnlyDir"`
+
+	// Environment variables set from secrets, mapping the variable name to the secret name
+	Secrets map[string]string `json:"secrets"`
+
+	// Authentication required to invoke the app. Omit to make the app public
+	Auth *appAuthRequest `json:"auth"`
+
+	// Requests per second allowed to reach the app. Omit for no limit
+	RateLimit *rateLimitRequest `json:"rateLimit"`
+
+	// Overrides for the server's container hardening defaults
+	Security *containerSecurityRequest `json:"security"`
+
+	// Protocol spoken by the app: http (default), h2c, h2, tcp, or udp. The HTTP/2 protocols are needed for gRPC,
+	// and tcp and udp apps are served on their own port by the stream proxy
+	Protocol      string `json:"protocol"`
+	TLSSkipVerify bool   `json:"tlsSkipVerify"`
+
+	// Use mutual TLS between the server and the container, with certificates from the internal CA
+	MTLS bool `json:"mtls"`
+
+	// Custom hostnames the built-in server routes to this app
+	Domains []string `json:"domains"`
+
+	// Whether to remove /app/<id> from the path before proxying. Defaults to true
+	StripPrefix *bool `json:"stripPrefix"`
+
+	// Headers set on the app's responses
+	Headers map[string]string `json:"headers"`
+
+	// Limits applied to requests sent to the app. Durations are strings like "30s"
+	MaxBodySize           int64    `json:"maxBodySize"`
+	Timeout               Duration `json:"timeout"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"`
 }
 
 // POSTing a message to this route will create a new app based on the parameters
@@ -69,6 +172,10 @@ type containerPostRequest struct {
 // If any errors occur during app creation, then the app will be cleaned up
 // to prevent bad or inconsistent states
 func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
 
 	id, err := trimPath("/admin/", r)
 	if err != nil {
@@ -76,11 +183,32 @@ func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := G.AppMgr.Get(id); ok {
+	// IDs are used in hostnames, paths, and file names, so they may only contain characters which
+	// are valid and never escaped in each
+	if !appIDPattern.MatchString(id) {
+		ErrorResponse(w, "Invalid app id, only letters, digits, _ and - are allowed: "+id, 400)
+		return
+	}
+
+	if reservedAppIDs[id] {
+		ErrorResponse(w, "App id is reserved: "+id, 400)
+		return
+	}
+
+	if app, ok := G.AppMgr.Get(id); ok {
+		if !principal.CanWrite(app) {
+			ErrorResponse(w, "Not allowed to modify this app", 403)
+			return
+		}
 		BasicResponse(w, "Container already exists", 200)
 		return
 	}
 
+	if !principal.CanCreate() {
+		ErrorResponse(w, "Not allowed to create apps", 403)
+		return
+	}
+
 	// Parse request body
 	reqBody := &containerPostRequest{}
 	defer r.Body.Close()
@@ -92,19 +220,130 @@ func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	protocol, err := parseProtocol(reqBody.Protocol)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	if checker, ok := appIngress(&App{Protocol: protocol}).(appIDChecker); ok {
+		if err := checker.checkAppID(id); err != nil {
+			ErrorResponse(w, err.Error(), 400)
+			return
+		}
+	}
+
+	if reqBody.MTLS && protocol == ProtocolH2C {
+		ErrorResponse(w, "Mutual TLS can't be used with the cleartext h2c protocol, use h2 instead", 400)
+		return
+	}
+
+	if isStream(protocol) && (reqBody.MTLS || reqBody.Auth != nil || reqBody.RateLimit != nil || len(reqBody.Domains) > 0 ||
+		len(reqBody.Headers) > 0 || reqBody.MaxBodySize != 0 || reqBody.Timeout != 0 || reqBody.ResponseHeaderTimeout != 0) {
+		ErrorResponse(w, "tcp and udp apps can't use mtls, auth, rateLimit, domains, headers, or HTTP limits", 400)
+		return
+	}
+
+	if reqBody.MaxBodySize < 0 || reqBody.Timeout < 0 || reqBody.ResponseHeaderTimeout < 0 {
+		ErrorResponse(w, "Limits must not be negative", 400)
+		return
+	}
+
+	// Rejections are recorded in the audit log with the response message
+	violations, err := G.ImagePolicy.Check(r.Context(), reqBody.Image)
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, err.Error(), 500)
+		return
+	}
+	if len(violations) > 0 {
+		G.Logger.Warning("Image policy violation by " + principal.Name + " from " + clientIP(r) + " for app " + id +
+			": image " + reqBody.Image + " breaks " + violatedRules(violations))
+		PolicyErrorResponse(w, reqBody.Image, violations)
+		return
+	}
+
+	dir, err := resolveMountDir(reqBody.Dir)
+	if err != nil {
+		G.Logger.Warning("Rejected mount of " + reqBody.Dir + " for app " + id + ": " + err.Error())
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	security := reqBody.Security.apply(G.ContainerSecurity)
+	if security.weakerThan(G.ContainerSecurity) && principal.Role != RoleAdmin {
+		ErrorResponse(w, "Only admins may weaken the container security defaults", 403)
+		return
+	}
+	if err := security.validate(); err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	if status, err := checkSecretRefs(principal, reqBody.Secrets); err != nil {
+		ErrorResponse(w, err.Error(), status)
+		return
+	}
+
+	domains, err := validateDomains(id, reqBody.Domains)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	if err := validateHeaders(reqBody.Headers); err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	auth, err := newAppAuth(reqBody.Auth)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	rateLimit, err := newRateLimit(reqBody.RateLimit, auth)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 400)
+		return
+	}
+
+	stripPrefix := true
+	if reqBody.StripPrefix != nil {
+		stripPrefix = *reqBody.StripPrefix
+	}
+
+	runner := NewDockerContainer(
+		id,                              // docker id
+		reqBody.Image,                   // docker image
+		id,                              // app id
+		dir,                             // mounted dir
+		strings.Split(reqBody.Cmd, " "), // start command
+		reqBody.Env,                     // environment variables
+	)
+	runner.ReadOnlyDir = reqBody.ReadOnlyDir
+	runner.Security = security
+	runner.Secrets = reqBody.Secrets
+	runner.Protocol = protocol
+	runner.TLSSkipVerify = reqBody.TLSSkipVerify
+	runner.MTLS = reqBody.MTLS
+	runner.ResponseHeaderTimeout = reqBody.ResponseHeaderTimeout
+
 	// Create the app in the app management service
 	if app, ok := G.AppMgr.Create(&App{
 		ID:             id,
+		Owner:          principal.Name,
 		LastInvocation: time.Unix(0, 0),
+		Protocol:       protocol,
+		Domains:        domains,
+		StripPrefix:    stripPrefix,
+		MaxBodySize:    reqBody.MaxBodySize,
+		Timeout:        reqBody.Timeout,
+		Headers:        reqBody.Headers,
+		Auth:           auth,
+		RateLimit:      rateLimit,
 		frontendURL:    "http://" + G.Addr + "/app/" + id,
-		Runner: NewDockerContainer(
-			id,                              // docker id
-			reqBody.Image,                   // docker image
-			id,                              // app id
-			reqBody.Dir,                     // mounted dir
-			strings.Split(reqBody.Cmd, " "), // start command
-			reqBody.Env,                     // environment variables
-		),
+		Runner:         runner,
 	}); ok {
 		// Initialize, create, and start the app
 		if err := app.Init(); err != nil {
@@ -117,7 +356,12 @@ func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
 		// Create ingress for the app
 		u, err := initAppIngress(app)
 		if err != nil {
-			_ = G.Ingress.Remove(app)
+			// The app can't be reached, so it is removed along with its container
+			_ = removeAppIngress(app)
+			if cleanupErr := app.Runner.Cleanup(); cleanupErr != nil {
+				G.Logger.LogError(cleanupErr)
+			}
+			G.AppMgr.Delete(app.ID)
 			G.Logger.LogError(err)
 			ErrorResponse(w, err.Error(), 500)
 			return
@@ -128,6 +372,8 @@ func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
 			return app
 		})
 
+		G.Certs.Prefetch(app)
+
 		G.Logger.Info("Successfully built container")
 
 		b, err := json.Marshal(app)
@@ -140,15 +386,43 @@ func (AdminHandler) post(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		_, _ = w.Write(b)
 	} else {
-		G.AppMgr.Delete(id)
-		G.Logger.LogError(err)
-		ErrorResponse(w, err.Error(), 500)
+		// Another request created the app since it was looked up. That app is left alone
+		ErrorResponse(w, "App is already being created: "+id, 409)
 		return
 	}
 }
 
+// Checks that every referenced secret exists and may be used by the principal.
+// Returns the status to respond with if not
+func checkSecretRefs(principal *Principal, refs map[string]string) (int, error) {
+	if len(refs) == 0 {
+		return 200, nil
+	}
+	if !G.Secrets.Enabled() {
+		return 400, errSecretsDisabled
+	}
+	for key, name := range refs {
+		if key == "" || strings.Contains(key, "=") {
+			return 400, errors.New("Invalid environment variable name: " + key)
+		}
+		secret, err := G.Secrets.Get(name)
+		if err != nil {
+			return 400, errors.New("Secret not found: " + name)
+		}
+		if !principal.CanWriteSecret(secret) {
+			return 403, errors.New("Not allowed to use secret: " + name)
+		}
+	}
+	return 200, nil
+}
+
 // Deletes any app specified and removes it from the service
 func (AdminHandler) delete(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
+
 	id, err := trimPath("/admin/", r)
 	if err != nil {
 		ErrorResponse(w, "Resource not found", 404)
@@ -156,6 +430,11 @@ func (AdminHandler) delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if app, ok := G.AppMgr.Get(id); ok {
+		if !principal.CanWrite(app) {
+			ErrorResponse(w, "Not allowed to delete this app", 403)
+			return
+		}
+
 		// Remove the app's runner
 		if err = app.Runner.Cleanup(); err != nil {
 			G.Logger.LogError(err)
@@ -181,29 +460,75 @@ func (AdminHandler) delete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Write and reload app ingress. If NoIngress is used, this is a nop
+// Ingress serving the app. tcp and udp apps are always served by the stream proxy
+func appIngress(app *App) IngressServer {
+	if isStream(app.Protocol) {
+		return G.Streams
+	}
+	return G.Ingress
+}
+
+// Serializes changes to the ingress. A reload applies every change staged since the last one,
+// so without it a change failing the check would roll back a concurrent request's change as
+// well, while that request reported success. Ingresses which report the outcome of each app's
+// change themselves (appReloader) only need it held while the change is staged, so concurrent
+// requests share a reload
+var ingressMu sync.Mutex
+
+// Reloads the ingress after a change to the app, which was staged with ingressMu held. The lock
+// is released while an appReloader applies the change, and held again when this returns
+func reloadAppIngress(ingress IngressServer, app *App) error {
+	if r, ok := ingress.(appReloader); ok {
+		ingressMu.Unlock()
+		defer ingressMu.Lock()
+		return r.reloadApp(app)
+	}
+	return ingress.Reload()
+}
+
+// Write and reload app ingress. If NoIngress is used, this is a nop. The request learns
+// whether its own change was applied
 func initAppIngress(app *App) (string, error) {
-	u, err := G.Ingress.Write(app)
+	ingressMu.Lock()
+	defer ingressMu.Unlock()
+
+	ingress := appIngress(app)
+	u, err := ingress.Write(app)
 	if err != nil {
 		return "", err
 	}
 
-	if err := G.Ingress.Reload(); err != nil {
+	if err := reloadAppIngress(ingress, app); err != nil {
 		return "", err
 	}
 
 	return u, nil
 }
 
-// Removes and resets app ingress without the specified app
+// Removes and resets app ingress without the specified app. Requests in flight on the app's own
+// listener are drained after ingressMu is released, so other apps can change meanwhile
 func removeAppIngress(app *App) error {
-	if err := G.Ingress.Remove(app); err != nil {
-		return err
+	ingressMu.Lock()
+	ingress := appIngress(app)
+	drain, err := closeAppIngress(ingress, app)
+	if err == nil {
+		err = reloadAppIngress(ingress, app)
 	}
+	ingressMu.Unlock()
 
-	if err := G.Ingress.Reload(); err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(context.Background(), G.DrainTimeout)
+	defer cancel()
+	if drainErr := drain(ctx); err == nil {
+		err = drainErr
 	}
+	return err
+}
 
-	return nil
+// Removes the app from the ingress, with ingressMu held. The returned function drains the
+// requests in flight to the app, and must be called once ingressMu is released
+func closeAppIngress(ingress IngressServer, app *App) (drain func(context.Context) error, err error) {
+	if c, ok := ingress.(appCloser); ok {
+		return c.closeApp(app), nil
+	}
+	return func(context.Context) error { return nil }, ingress.Remove(app)
 }
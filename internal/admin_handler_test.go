@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostAppIDs(t *testing.T) {
+	testGlobal(t)
+
+	tests := []struct {
+		path string
+		want string // Start of the error message
+	}{
+		{"/admin/", "Invalid app id"},
+		{"/admin/my.app", "Invalid app id"},
+		{"/admin/..", "Invalid app id"},
+		{"/admin/app/keys", "Invalid app id"},
+		{"/admin/my%20app", "Invalid app id"},
+		{"/admin/caf%C3%A9", "Invalid app id"},
+		{"/admin/secrets", "App id is reserved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"image":"nginx"}`))
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Name: "admin", Role: RoleAdmin}))
+			w := httptest.NewRecorder()
+			AdminHandler{}.post(w, r)
+			if w.Code != 400 || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("response = %d %s, want 400 %q", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,20 @@ type App struct {
 	ID             string    `json:"id"`             // Unique ID for this app instance
 	LastInvocation time.Time `json:"lastInvocation"` // Time of the last invocation
 	ExternalURL    string    `json:"externalUrl"`
+	Owner          string    `json:"owner"`    // Name of the principal which created the app
+	Protocol       string    `json:"protocol"` // Protocol clients use to reach the app: http, h2c, h2, tcp, or udp
+	Domains        []string  `json:"domains"`  // Custom hostnames routed to this app by the built-in server
+
+	// Remove the /app/<id> prefix before proxying. The prefix is passed to the app in X-Forwarded-Prefix
+	StripPrefix bool `json:"stripPrefix"`
+
+	MaxBodySize int64    `json:"maxBodySize"` // Largest request body accepted, in bytes. 0 means no limit
+	Timeout     Duration `json:"timeout"`     // Time allowed for the app to respond to a request. 0 means no limit
+
+	Headers map[string]string `json:"headers"` // Headers set on the app's responses
+
+	Auth      *AppAuth   `json:"auth"`      // Authentication required to invoke the app. nil means the app is public
+	RateLimit *RateLimit `json:"rateLimit"` // Requests allowed to reach the app. nil means no limit
 
 	// Reverse proxy-facing url, could be user-facing if no ingress
 	frontendURL string
@@ -29,7 +43,9 @@ func (app *App) Init() error {
 type AppServiceRunner interface {
 	Create() error
 	Cleanup() error
+	StopJobs() // Stop background jobs without touching the running service
 	IsReady() bool
 	BlockUntilReady()
 	Invoke(w http.ResponseWriter, r *http.Request)
+	Addr() string // Address the service accepts tcp and udp connections on
 }
@@ -0,0 +1,257 @@
+package internal
+
+// app_auth.go
+// Authentication for requests sent to apps. An app may require one of:
+//
+//   - apikey: keys issued through /admin/<id>/keys, sent in an X-API-Key header or as a bearer token
+//   - basic: HTTP basic auth against users configured with the app, with bcrypt-hashed passwords
+//   - jwt: bearer JWTs signed by a key in the server's JWKS file, with the app's audience
+//
+// Credentials are checked before the app is started, so unauthenticated requests can never
+// wake a container. The authenticated identity is passed to the app in X-Authenticated-User
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AppAuthAPIKey = "apikey"
+	AppAuthBasic  = "basic"
+	AppAuthJWT    = "jwt"
+)
+
+var (
+	errNoCredentials      = errors.New("Authentication required")
+	errInvalidCredentials = errors.New("Invalid credentials")
+)
+
+// Compared against when a basic auth user doesn't exist, so that the response time
+// doesn't reveal which users exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// AppAPIKey is an API key issued for an app. Only a hash of the key is kept
+type AppAPIKey struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	hash      []byte
+}
+
+// AppAuth is the authentication required to invoke an app
+type AppAuth struct {
+	Type     string       `json:"type"`
+	APIKeys  []*AppAPIKey `json:"apiKeys,omitempty"`
+	Users    []string     `json:"users,omitempty"`
+	Issuer   string       `json:"issuer,omitempty"`
+	Audience string       `json:"audience,omitempty"`
+
+	mu        sync.RWMutex
+	passwords map[string][]byte
+}
+
+// appAuthRequest configures authentication when creating an app
+type appAuthRequest struct {
+	Type     string            `json:"type"`
+	Users    map[string]string `json:"users"`    // basic: username to password
+	Issuer   string            `json:"issuer"`   // jwt: required iss claim, optional
+	Audience string            `json:"audience"` // jwt: required aud claim
+}
+
+// Creates the authentication settings for an app. A nil request means the app is public
+func newAppAuth(req *appAuthRequest) (*AppAuth, error) {
+	if req == nil || req.Type == "" {
+		return nil, nil
+	}
+
+	auth := &AppAuth{Type: req.Type}
+
+	switch req.Type {
+	case AppAuthAPIKey:
+	case AppAuthBasic:
+		if len(req.Users) == 0 {
+			return nil, errors.New("Basic auth requires at least one user")
+		}
+		auth.passwords = make(map[string][]byte, len(req.Users))
+		for user, password := range req.Users {
+			if user == "" || strings.Contains(user, ":") || password == "" {
+				return nil, errors.New("Invalid basic auth user: " + user)
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, err
+			}
+			auth.passwords[user] = hash
+			auth.Users = append(auth.Users, user)
+		}
+	case AppAuthJWT:
+		if !G.JWKS.Enabled() {
+			return nil, errors.New("JWT auth requires the server to be started with a JWKS file")
+		}
+		if req.Audience == "" {
+			return nil, errors.New("JWT auth requires an audience")
+		}
+		auth.Issuer = req.Issuer
+		auth.Audience = req.Audience
+	default:
+		return nil, errors.New("Unsupported auth type: " + req.Type)
+	}
+
+	return auth, nil
+}
+
+func hashAPIKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// IssueKey creates a new API key. The returned key is only available now, since only its hash is kept
+func (a *AppAuth) IssueKey() (*AppAPIKey, string, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := &AppAPIKey{
+		ID:        hex.EncodeToString(id),
+		CreatedAt: time.Now().UTC(),
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	key.hash = hashAPIKey(s)
+
+	a.mu.Lock()
+	a.APIKeys = append(a.APIKeys, key)
+	a.mu.Unlock()
+
+	return key, key.ID + "." + s, nil
+}
+
+// RevokeKey deletes the API key. Returns false if there is no such key
+func (a *AppAuth) RevokeKey(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, key := range a.APIKeys {
+		if key.ID == id {
+			a.APIKeys = append(a.APIKeys[:i:i], a.APIKeys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON holds the lock, since keys may be issued or revoked while the app is listed
+func (a *AppAuth) MarshalJSON() ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return json.Marshal(&struct {
+		Type     string       `json:"type"`
+		APIKeys  []*AppAPIKey `json:"apiKeys,omitempty"`
+		Users    []string     `json:"users,omitempty"`
+		Issuer   string       `json:"issuer,omitempty"`
+		Audience string       `json:"audience,omitempty"`
+	}{a.Type, a.APIKeys, a.Users, a.Issuer, a.Audience})
+}
+
+// Keys returns the metadata of the app's API keys
+func (a *AppAuth) Keys() []*AppAPIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]*AppAPIKey{}, a.APIKeys...)
+}
+
+func (a *AppAuth) checkAPIKey(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidCredentials
+	}
+	hash := hashAPIKey(parts[1])
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, key := range a.APIKeys {
+		if key.ID == parts[0] && subtle.ConstantTimeCompare(key.hash, hash) == 1 {
+			return "key:" + key.ID, nil
+		}
+	}
+	return "", errInvalidCredentials
+}
+
+func (a *AppAuth) checkBasic(user, password string) (string, error) {
+	a.mu.RLock()
+	hash, ok := a.passwords[user]
+	a.mu.RUnlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", errInvalidCredentials
+	}
+	return "user:" + user, nil
+}
+
+// Authenticate checks the request's credentials and returns the identity of the caller,
+// prefixed by the kind of credential: key:<key id>, user:<name>, or sub:<subject>
+func (a *AppAuth) Authenticate(r *http.Request) (string, error) {
+	switch a.Type {
+	case AppAuthAPIKey:
+		token := r.Header.Get("X-API-Key")
+		if token == "" {
+			token, _ = bearerToken(r)
+		}
+		if token == "" {
+			return "", errNoCredentials
+		}
+		return a.checkAPIKey(token)
+	case AppAuthBasic:
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return "", errNoCredentials
+		}
+		return a.checkBasic(user, password)
+	case AppAuthJWT:
+		token, ok := bearerToken(r)
+		if !ok {
+			return "", errNoCredentials
+		}
+		sub, err := G.JWKS.Verify(token, a.Issuer, a.Audience)
+		if err != nil {
+			return "", err
+		}
+		return "sub:" + sub, nil
+	default:
+		return "", errInvalidCredentials
+	}
+}
+
+// Value for the WWW-Authenticate header sent with a 401
+func (a *AppAuth) challenge(appID string) string {
+	if a.Type == AppAuthBasic {
+		return `Basic realm="` + appID + `", charset="UTF-8"`
+	}
+	return `Bearer realm="` + appID + `"`
+}
+
+// Removes credentials the app has no use for before the request is proxied. JWTs are kept
+// since the app may want to read their claims
+func (a *AppAuth) scrubCredentials(r *http.Request) {
+	switch a.Type {
+	case AppAuthAPIKey:
+		r.Header.Del("X-API-Key")
+		r.Header.Del("Authorization")
+	case AppAuthBasic:
+		r.Header.Del("Authorization")
+	}
+}
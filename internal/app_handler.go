@@ -2,12 +2,14 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
+// AppHandler routes requests sent to /app/<app id>/... to the app
 type AppHandler struct{}
 
 func (AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -15,7 +17,7 @@ func (AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if len(parts) < 3 {
 		G.Logger.Warning("Invalid request: " + r.URL.Path)
-		ErrorResponse(w, "Container not found", 404)
+		appErrorResponse(w, r, "Container not found", 404)
 		return
 	}
 
@@ -24,46 +26,173 @@ func (AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	app, ok := G.AppMgr.Get(id)
 	if !ok {
 		G.Logger.Warning("App not found")
-		ErrorResponse(w, "App not found", 404)
+		appErrorResponse(w, r, "App not found", 404)
 		return
 	}
 
-	// Create the container if it was evicted
-	if !app.Runner.IsReady() {
-		if err := app.Runner.Create(); err != nil {
-			_ = app.Runner.Cleanup()
-			G.Logger.LogError(err)
-			ErrorResponse(w, err.Error(), 500)
+	serveApp(w, r, app, "/app/"+app.ID)
+}
+
+// Starts the app if necessary and proxies the request to it. prefix is the part of
+// the path used to route the request, which is removed unless the app keeps it
+func serveApp(w http.ResponseWriter, r *http.Request, app *App, prefix string) {
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		G.Logger.Error("Invalid URL")
+		appErrorResponse(w, r, "Invalid URL", 404)
+		return
+	}
+
+	if isStream(app.Protocol) {
+		appErrorResponse(w, r, "The app serves "+app.Protocol+" connections, not HTTP requests", 400)
+		return
+	}
+
+	if !inflight.start() {
+		appErrorResponse(w, r, "Server is shutting down", 503)
+		return
+	}
+	defer inflight.done()
+
+	// Limits which don't depend on the caller's identity are applied first, so they also slow down credential guessing
+	if app.RateLimit != nil && !app.RateLimit.byIdentity() && !app.RateLimit.Allow(w, r, "") {
+		appErrorResponse(w, r, "Rate limit exceeded", 429)
+		return
+	}
+
+	// Check credentials before anything else, so unauthenticated requests can't wake the container
+	invoker := ""
+	if app.Auth != nil {
+		var err error
+		if invoker, err = app.Auth.Authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", app.Auth.challenge(app.ID))
+			appErrorResponse(w, r, err.Error(), 401)
 			return
 		}
 	}
 
-	// Hopefully the client will quit waiting if there is a problem
-	// This state probably won't happen since we create the app just before this line
-	// and return an error message to the client if something goes wrong
-	app.Runner.BlockUntilReady()
+	if app.RateLimit != nil && app.RateLimit.byIdentity() && !app.RateLimit.Allow(w, r, invoker) {
+		appErrorResponse(w, r, "Rate limit exceeded", 429)
+		return
+	}
 
-	trimLen := len("/app/" + app.ID)
-	if len(r.URL.Path) < trimLen {
-		G.Logger.Error("Invalid URL")
-		ErrorResponse(w, "Invalid URL", 404)
+	// Reject oversized requests without waking the container when the size is known up front
+	if app.MaxBodySize > 0 && r.ContentLength > app.MaxBodySize {
+		appErrorResponse(w, r, errBodyTooLarge.Error(), 413)
 		return
 	}
 
-	// Rewrite path and pass to proxy
-	u := r.URL.String()[trimLen:]
-	urlRewrite, err := url.Parse(u)
-	if err != nil {
+	if err := wakeApp(app); err != nil {
 		G.Logger.LogError(err)
-		ErrorResponse(w, err.Error(), 500)
+		appErrorResponse(w, r, err.Error(), 500)
 		return
 	}
-	proxyRequest := r.Clone(context.Background())
-	proxyRequest.URL = urlRewrite
 
+	ctx := r.Context()
+	if app.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(app.Timeout))
+		defer cancel()
+	}
+	if len(app.Headers) > 0 {
+		ctx = context.WithValue(ctx, appHeadersKey{}, app.Headers)
+	}
+
+	proxyRequest := r.Clone(ctx)
+	proxyRequest.Header.Del("X-Authenticated-User")
+	if app.Auth != nil {
+		app.Auth.scrubCredentials(proxyRequest)
+		proxyRequest.Header.Set("X-Authenticated-User", invoker)
+	}
+	if app.MaxBodySize > 0 {
+		proxyRequest = limitRequestBody(proxyRequest, app.MaxBodySize)
+	}
+	if app.StripPrefix {
+		proxyRequest.URL = stripPathPrefix(r.URL, prefix)
+		setForwardedHeaders(proxyRequest, r, prefix)
+	} else {
+		setForwardedHeaders(proxyRequest, r, "")
+	}
+
+	touchApp(app)
+	app.Runner.Invoke(w, proxyRequest)
+}
+
+// Creates the container if it was evicted and waits until the app is ready
+func wakeApp(app *App) error {
+	if !app.Runner.IsReady() {
+		if err := app.Runner.Create(); err != nil {
+			_ = app.Runner.Cleanup()
+			return err
+		}
+	}
+
+	// Hopefully the client will quit waiting if there is a problem
+	// This state probably won't happen since we create the app just before this line
+	// and return an error to the client if something goes wrong
+	app.Runner.BlockUntilReady()
+	return nil
+}
+
+// Records an invocation of the app, which keeps it from being stopped or evicted for being idle
+func touchApp(app *App) {
 	G.AppMgr.Update(app.ID, func() *App {
 		app.LastInvocation = time.Now()
 		return app
 	})
-	app.Runner.Invoke(w, proxyRequest)
+}
+
+// Copies the url with the prefix removed from its path. The result always has an absolute path
+func stripPathPrefix(u *url.URL, prefix string) *url.URL {
+	stripped := *u
+	stripped.Path = strings.TrimPrefix(u.Path, prefix)
+	if !strings.HasPrefix(stripped.Path, "/") {
+		stripped.Path = "/" + stripped.Path
+	}
+	if u.RawPath != "" {
+		// App IDs are checked against appIDPattern when apps are created, so they only contain
+		// characters which are never escaped, and the prefix is the same in both forms
+		stripped.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+		if !strings.HasPrefix(stripped.RawPath, "/") {
+			stripped.RawPath = "/" + stripped.RawPath
+		}
+	}
+	return &stripped
+}
+
+// Error response for requests sent to an app. gRPC clients receive the error as a gRPC status
+func appErrorResponse(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if isGRPCRequest(r) {
+		GRPCErrorResponse(w, message, status)
+	} else {
+		ErrorResponse(w, message, status)
+	}
+}
+
+// Context key for the headers set on an app's responses
+type appHeadersKey struct{}
+
+// Called by an app's reverse proxy with the container's response. Sets the app's headers,
+// which serveApp passes along in the request's context, so they apply whichever way the
+// app is reached
+func setAppHeaders(resp *http.Response) error {
+	headers, _ := resp.Request.Context().Value(appHeadersKey{}).(map[string]string)
+	for name, value := range headers {
+		resp.Header.Set(name, value)
+	}
+	return nil
+}
+
+// Called by an app's reverse proxy when the request to the container fails
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case bodyLimitExceeded(r):
+		appErrorResponse(w, r, errBodyTooLarge.Error(), 413)
+	case errors.Is(err, errResponseHeaderTimeout):
+		appErrorResponse(w, r, err.Error(), 504)
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		appErrorResponse(w, r, "Timeout waiting for app", 504)
+	default:
+		G.Logger.LogError(err)
+		appErrorResponse(w, r, "Could not reach app", 502)
+	}
 }
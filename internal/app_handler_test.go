@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// proxyRunner proxies requests to a test server the way DockerContainerRunner proxies to a container
+type proxyRunner struct {
+	fakeRunner
+	proxy *httputil.ReverseProxy
+}
+
+func (p *proxyRunner) Invoke(w http.ResponseWriter, r *http.Request) {
+	p.proxy.ServeHTTP(w, r)
+}
+
+func TestAppHeadersOnResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "ALLOWALL")
+		w.Header().Set("X-App", "kept")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = setAppHeaders
+
+	g := testGlobal(t,
+		&App{ID: "app", StripPrefix: true, Runner: &proxyRunner{proxy: proxy},
+			Headers: map[string]string{"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=63072000"}},
+		&App{ID: "plain", StripPrefix: true, Runner: &proxyRunner{proxy: proxy}},
+	)
+	g.AppDomain = "apps.example.com"
+
+	tests := []struct {
+		name, url string
+		want      map[string]string
+	}{
+		{"path route", "http://localhost:3000/app/app/", map[string]string{"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=63072000", "X-App": "kept"}},
+		{"host route", "http://app.apps.example.com/", map[string]string{"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=63072000", "X-App": "kept"}},
+		{"app without headers", "http://plain.apps.example.com/", map[string]string{"X-Frame-Options": "ALLOWALL", "Strict-Transport-Security": "", "X-App": "kept"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			testAppMux().ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			if w.Code != 200 {
+				t.Fatalf("server responded %d: %s", w.Code, w.Body.String())
+			}
+			for name, want := range tt.want {
+				if got := w.Header().Values(name); len(got) > 1 || w.Header().Get(name) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"security headers", map[string]string{"X-Frame-Options": "DENY", "Content-Security-Policy": "default-src 'self'"}, false},
+		{"invalid name", map[string]string{"X Frame": "DENY"}, true},
+		{"newline in value", map[string]string{"X-Test": "a\r\nSet-Cookie: b"}, true},
+		{"nginx variable", map[string]string{"X-Test": "$host"}, true},
+		{"haproxy sample", map[string]string{"X-Test": "%[src]"}, true},
+		{"non-ascii", map[string]string{"X-Test": "café"}, true},
+		{"framing header", map[string]string{"content-length": "0"}, true},
+		{"hop-by-hop header", map[string]string{"Connection": "close"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateHeaders(tt.headers); (err != nil) != tt.wantErr {
+				t.Errorf("validateHeaders error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
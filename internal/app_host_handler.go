@@ -0,0 +1,117 @@
+package internal
+
+// app_host_handler.go
+// Routes requests to apps based on the Host header instead of the /app/<id> path prefix.
+// An app can be reached at <id>.<app domain> when an app domain is configured, and at any
+// custom domains registered for it. Requests are passed to the app without any path rewriting,
+// so the app is served at its own root
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var appIDPattern = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// Domains are written into ingress configuration, so only plain hostnames are accepted
+var domainPattern = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// AppHostHandler serves apps by hostname. It is registered with RegexMux.HandleHost
+// so that only requests for app hostnames are routed to it
+type AppHostHandler struct{}
+
+func (AppHostHandler) MatchHost(host string) bool {
+	if isServerHost(normalizeHost(host)) {
+		return false
+	}
+	_, ok := appForHost(host)
+	return ok
+}
+
+func (AppHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app, ok := appForHost(r.Host)
+	if !ok {
+		appErrorResponse(w, r, "App not found", 404)
+		return
+	}
+
+	serveApp(w, r, app, "")
+}
+
+// Finds the app served at a hostname, either a subdomain of the app domain or a custom domain
+func appForHost(host string) (*App, bool) {
+	host = normalizeHost(host)
+	if host == "" {
+		return nil, false
+	}
+
+	if G.AppDomain != "" && strings.HasSuffix(host, "."+G.AppDomain) {
+		id := strings.TrimSuffix(host, "."+G.AppDomain)
+		if appIDPattern.MatchString(id) {
+			return G.AppMgr.Get(id)
+		}
+	}
+
+	for _, app := range G.AppMgr.List() {
+		for _, domain := range app.Domains {
+			if domain == host {
+				return app, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Indicates whether a normalized host is a name of the server itself, which no app may take
+func isServerHost(host string) bool {
+	for _, h := range G.ServerHosts {
+		if h == host {
+			return true
+		}
+	}
+	for _, name := range G.Certs.defaultNames() {
+		if normalizeHost(name) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Lowercases the host and removes any port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Checks the custom domains requested for an app. Domains must be unique across apps and
+// must not shadow another app's subdomain of the app domain
+func validateDomains(id string, domains []string) ([]string, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		d := normalizeHost(domain)
+		if !domainPattern.MatchString(d) {
+			return nil, errors.New("Invalid domain: " + domain)
+		}
+
+		// Claiming the server's own hostname would shadow the admin routes
+		if isServerHost(d) {
+			return nil, errors.New("Domain is reserved for the server: " + domain)
+		}
+
+		if G.AppDomain != "" && strings.HasSuffix(d, "."+G.AppDomain) && d != id+"."+G.AppDomain {
+			return nil, errors.New("Domain is reserved for another app: " + domain)
+		}
+
+		if app, ok := appForHost(d); ok && app.ID != id {
+			return nil, errors.New("Domain is already used by app " + app.ID + ": " + domain)
+		}
+
+		normalized = append(normalized, d)
+	}
+	return normalized, nil
+}
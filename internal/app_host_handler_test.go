@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Sets up a global state with the given apps, restoring the previous one when the test ends
+func testGlobal(t *testing.T, apps ...*App) *Global {
+	prev := G
+	t.Cleanup(func() { G = prev })
+
+	G = &Global{
+		Logger: &Logger{infoLog: ioutil.Discard, errorLog: ioutil.Discard},
+		AppMgr: &DefaultAppManager{apps: make(map[string]*App), appMu: &sync.Mutex{}},
+	}
+	for _, app := range apps {
+		G.AppMgr.apps[app.ID] = app
+	}
+	return G
+}
+
+func TestValidateDomains(t *testing.T) {
+	g := testGlobal(t, &App{ID: "other", Domains: []string{"taken.example.com"}})
+	g.AppDomain = "apps.example.com"
+	g.ServerHosts = []string{"admin.example.com", "localhost"}
+
+	tests := []struct {
+		name    string
+		domains []string
+		want    []string
+		wantErr bool
+	}{
+		{"none", nil, []string{}, false},
+		{"normalized", []string{"WWW.Example.com.", "shop.example.com:443"}, []string{"www.example.com", "shop.example.com"}, false},
+		{"own subdomain", []string{"app.apps.example.com"}, []string{"app.apps.example.com"}, false},
+		{"invalid", []string{"bad domain"}, nil, true},
+		{"server host", []string{"admin.example.com"}, nil, true},
+		{"server host with case and port", []string{"Admin.Example.com:8080"}, nil, true},
+		{"localhost", []string{"localhost"}, nil, true},
+		{"another app's subdomain", []string{"other.apps.example.com"}, nil, true},
+		{"another app's domain", []string{"taken.example.com"}, nil, true},
+		{"one bad domain fails all", []string{"ok.example.com", "admin.example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateDomains("app", tt.domains)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateDomains(%q) error = %v, wantErr %v", tt.domains, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("validateDomains(%q) = %q, want %q", tt.domains, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("validateDomains(%q) = %q, want %q", tt.domains, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// An app claiming the server's hostname, such as one created before it was reserved, must
+// never receive /admin requests
+func TestServerRoutes(t *testing.T) {
+	g := testGlobal(t, &App{ID: "app", Domains: []string{"app.example.com"}})
+	g.AppDomain = "apps.example.com"
+	g.ServerHosts = []string{"admin.example.com"}
+
+	var got string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) { got = name })
+	}
+	mux := &RegexMux{NotFound: handler("")}
+	mux.HandleHost(AppHostHandler{}, handler("app"))
+	mux.HandleServer("^/admin/", handler("admin"))
+
+	tests := []struct {
+		host, path, want string
+	}{
+		{"admin.example.com", "/admin/app", "admin"},
+		{"other.example.com", "/admin/app", "admin"},
+		{"admin.example.com", "/", ""},
+		{"app.apps.example.com", "/admin/x", "app"},
+		{"app.example.com", "/admin/x", "app"},
+		{"app.example.com", "/", "app"},
+	}
+	for _, tt := range tests {
+		got = ""
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil))
+		if got != tt.want {
+			t.Errorf("%s%s handled by %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// app_keys_handler.go
+// Admin routes for the API keys of apps using apikey authentication. A key is returned
+// only when it is issued, afterwards just its id and creation time can be read
+package internal
+
+import (
+	"net/http"
+	"strings"
+)
+
+type AppKeysHandler struct{}
+
+// Handles /admin/<app id>/keys and /admin/<app id>/keys/<key id>
+func (h AppKeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	rest, err := trimPath("/admin/", r)
+	if err != nil {
+		ErrorResponse(w, "Resource not found", 404)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	id := parts[0]
+	keyID := ""
+	if len(parts) > 2 {
+		keyID = parts[2]
+	}
+
+	app, ok := G.AppMgr.Get(id)
+	if !ok {
+		ErrorResponse(w, "App not found", 404)
+		return
+	}
+	if app.Auth == nil || app.Auth.Type != AppAuthAPIKey {
+		ErrorResponse(w, "App does not use API key authentication", 400)
+		return
+	}
+
+	target := auditTarget{
+		appID: id,
+		snapshot: func() interface{} {
+			return app.Auth.Keys()
+		},
+	}
+
+	switch {
+	case r.Method == "GET" && keyID == "":
+		if !principal.CanRead(app) {
+			ErrorResponse(w, "Not allowed to view this app", 403)
+			return
+		}
+		writeJSON(w, app.Auth.Keys())
+	case r.Method == "POST" && keyID == "":
+		target.action = "app.key.issue"
+		G.Audit.audit(w, r, target, func(w http.ResponseWriter, r *http.Request) {
+			h.issue(w, principal, app)
+		})
+	case r.Method == "DELETE" && keyID != "":
+		target.action = "app.key.revoke"
+		G.Audit.audit(w, r, target, func(w http.ResponseWriter, r *http.Request) {
+			h.revoke(w, principal, app, keyID)
+		})
+	default:
+		ErrorResponse(w, "HTTP Method not supported", 400)
+	}
+}
+
+type issuedKeyResponse struct {
+	*AppAPIKey
+	Key string `json:"key"`
+}
+
+func (AppKeysHandler) issue(w http.ResponseWriter, principal *Principal, app *App) {
+	if !principal.CanWrite(app) {
+		ErrorResponse(w, "Not allowed to modify this app", 403)
+		return
+	}
+
+	key, secret, err := app.Auth.IssueKey()
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, "Could not issue key", 500)
+		return
+	}
+
+	writeJSON(w, &issuedKeyResponse{key, secret})
+}
+
+func (AppKeysHandler) revoke(w http.ResponseWriter, principal *Principal, app *App, keyID string) {
+	if !principal.CanWrite(app) {
+		ErrorResponse(w, "Not allowed to modify this app", 403)
+		return
+	}
+
+	if !app.Auth.RevokeKey(keyID) {
+		ErrorResponse(w, "Key not found", 404)
+		return
+	}
+
+	w.WriteHeader(200)
+}
@@ -27,6 +27,9 @@ type AppManager interface {
 	// action within a mutex lock (for in-memory stores)
 	Update(string, func() *App) bool
 
+	// List all containers or functions. The order is unspecified
+	List() []*App
+
 	// Deletes the container or function with the id
 	// No success bool is returned since the end-result should be
 	// the same: no reference to the app should remain
@@ -71,6 +74,16 @@ func (mgr *DefaultAppManager) Update(id string, updater func() *App) bool {
 	return false
 }
 
+func (mgr *DefaultAppManager) List() []*App {
+	mgr.appMu.Lock()
+	defer mgr.appMu.Unlock()
+	apps := make([]*App, 0, len(mgr.apps))
+	for _, app := range mgr.apps {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
 func (mgr *DefaultAppManager) Delete(id string) {
 	mgr.appMu.Lock()
 	delete(mgr.apps, id)
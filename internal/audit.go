@@ -0,0 +1,391 @@
+package internal
+
+// audit.go
+// Append-only log of admin actions. Every mutating admin request is written as one json
+// line recording who made it, from where, what changed, and whether it succeeded.
+// The file is rotated once it reaches its maximum size, keeping a number of older files
+// named <file>.1 (most recent) through <file>.N
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest request body read for the audit log. Admin requests are small json documents, and
+// the body is held in memory so it can be recorded and passed on to the handler
+const maxAuditedBodySize = 1 << 20
+
+// AuditChange is the value of a field before and after an action
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditEntry is a single line in the audit log
+type AuditEntry struct {
+	Time      time.Time              `json:"time"`
+	Principal string                 `json:"principal"`
+	Role      Role                   `json:"role"`
+	SourceIP  string                 `json:"sourceIp"`
+	Action    string                 `json:"action"`
+	AppID     string                 `json:"appId,omitempty"`
+	Secret    string                 `json:"secret,omitempty"`
+	Request   json.RawMessage        `json:"request,omitempty"` // Request body, with environment values redacted
+	Diff      map[string]AuditChange `json:"diff,omitempty"`    // Changed fields, keyed by their dotted json path
+	Status    int                    `json:"status"`
+	Outcome   string                 `json:"outcome"` // success, denied, or failed
+	Message   string                 `json:"message,omitempty"`
+}
+
+// AuditLog writes audit entries to a file
+type AuditLog struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens the audit log for appending. An empty path disables the log
+func NewAuditLog(path string, maxSize int64, backups int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, backups: backups}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Enabled() bool {
+	return a.path != ""
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// Shifts <file>.N-1 to <file>.N, down to moving the current file to <file>.1, and starts a new file
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	for i := a.backups; i > 1; i-- {
+		_ = os.Rename(a.path+"."+strconv.Itoa(i-1), a.path+"."+strconv.Itoa(i))
+	}
+	if a.backups > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record appends the entry to the log. Failures are logged but never fail the request
+func (a *AuditLog) Record(entry *AuditEntry) {
+	if !a.Enabled() {
+		return
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		G.Logger.LogError(err)
+		return
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			G.Logger.LogError(err)
+			return
+		}
+	}
+
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		G.Logger.LogError(err)
+	}
+}
+
+// AuditQuery filters the entries returned by Query. Empty fields match everything
+type AuditQuery struct {
+	AppID     string
+	Secret    string
+	Principal string
+	Action    string
+	Since     time.Time
+	Limit     int
+}
+
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	return (q.AppID == "" || e.AppID == q.AppID) &&
+		(q.Secret == "" || e.Secret == q.Secret) &&
+		(q.Principal == "" || e.Principal == q.Principal) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since))
+}
+
+// Query returns the most recent entries matching the query, oldest first.
+// Rotated files are read too, so results span every file still on disk
+func (a *AuditLog) Query(q *AuditQuery) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+	if !a.Enabled() {
+		return entries, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	files := []string{a.path}
+	for i := 1; i <= a.backups; i++ {
+		files = append([]string{a.path + "." + strconv.Itoa(i)}, files...)
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := &AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				continue
+			}
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// Flattens a value's json form into a map keyed by dotted paths. Arrays are kept whole
+func flattenJSON(v interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	if v == nil {
+		return flat
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return flat
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return flat
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return flat
+	}
+
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, child := range m {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				walk(k, child)
+			}
+			return
+		}
+		flat[prefix] = v
+	}
+	walk("", generic)
+	return flat
+}
+
+// Fields which hold environment variables. Their values are redacted in the audit log
+// since secrets are sometimes passed as plain environment variables
+func isEnvField(key string) bool {
+	return key == "env" || strings.HasSuffix(key, ".Env")
+}
+
+// Replaces the values of KEY=value entries with a placeholder
+func redactEnv(v interface{}) interface{} {
+	list, ok := v.([]interface{})
+	if !ok {
+		return v
+	}
+	redacted := make([]interface{}, len(list))
+	for i, item := range list {
+		if s, ok := item.(string); ok {
+			redacted[i] = strings.SplitN(s, "=", 2)[0] + "=[redacted]"
+		} else {
+			redacted[i] = item
+		}
+	}
+	return redacted
+}
+
+// Compares two flattened values, returning the fields which differ
+func auditDiff(from, to map[string]interface{}) map[string]AuditChange {
+	keys := make(map[string]bool)
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+
+	diff := make(map[string]AuditChange)
+	for k := range keys {
+		if reflect.DeepEqual(from[k], to[k]) {
+			continue
+		}
+		change := AuditChange{from[k], to[k]}
+		if isEnvField(k) {
+			change = AuditChange{redactEnv(from[k]), redactEnv(to[k])}
+		}
+		diff[k] = change
+	}
+	return diff
+}
+
+// Redacts environment values and basic auth passwords in a json request body
+func redactRequest(body []byte) json.RawMessage {
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil
+	}
+	for k, v := range m {
+		if isEnvField(k) {
+			m[k] = redactEnv(v)
+		}
+	}
+	if auth, ok := m["auth"].(map[string]interface{}); ok {
+		if users, ok := auth["users"].(map[string]interface{}); ok {
+			for user := range users {
+				users[user] = "[redacted]"
+			}
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// auditRecorder captures the status and error message of a response
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	// Only error messages are needed, which are short
+	if rec.body.Len() < 4096 {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// auditTarget describes the resource a mutating admin request acts on
+type auditTarget struct {
+	action   string
+	appID    string
+	secret   string
+	snapshot func() interface{} // Current state of the resource, or a nil pointer if it doesn't exist
+	request  bool               // Record the request body. Must be false when the body holds secret values
+}
+
+// Runs the handler and records the request in the audit log
+func (a *AuditLog) audit(w http.ResponseWriter, r *http.Request, target auditTarget, handle func(http.ResponseWriter, *http.Request)) {
+	principal, _ := PrincipalFromRequest(r)
+
+	entry := &AuditEntry{
+		Time:     time.Now().UTC(),
+		SourceIP: clientIP(r),
+		Action:   target.action,
+		AppID:    target.appID,
+		Secret:   target.secret,
+	}
+	if principal != nil {
+		entry.Principal = principal.Name
+		entry.Role = principal.Role
+	}
+
+	if target.request && r.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuditedBodySize+1))
+		_ = r.Body.Close()
+		if err != nil {
+			ErrorResponse(w, "Could not read request body", 400)
+			return
+		}
+		if len(body) > maxAuditedBodySize {
+			ErrorResponse(w, "Request body too large", 413)
+			return
+		}
+		entry.Request = redactRequest(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// The state is flattened right away since the handler may modify the resource in place
+	before := flattenJSON(target.snapshot())
+	rec := &auditRecorder{ResponseWriter: w, status: 200}
+	handle(rec, r)
+
+	entry.Status = rec.status
+	entry.Diff = auditDiff(before, flattenJSON(target.snapshot()))
+
+	switch {
+	case rec.status < 400:
+		entry.Outcome = "success"
+	case rec.status == 401 || rec.status == 403:
+		entry.Outcome = "denied"
+	default:
+		entry.Outcome = "failed"
+	}
+	if rec.status >= 400 {
+		msg := &basicResponse{}
+		if json.Unmarshal(rec.body.Bytes(), msg) == nil {
+			entry.Message = msg.Message
+		}
+	}
+
+	a.Record(entry)
+}
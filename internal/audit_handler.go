@@ -0,0 +1,67 @@
+// audit_handler.go
+// Admin route for querying the audit log. Only admins and viewers may read it, since
+// it records actions on every app
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AuditHandler struct{}
+
+// Returns the audit entries matching the query parameters app, secret, principal, action,
+// since (RFC 3339), and limit (default 100), oldest first
+func (AuditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		ErrorResponse(w, "HTTP Method not supported", 400)
+		return
+	}
+
+	if principal.Role != RoleAdmin && principal.Role != RoleViewer {
+		ErrorResponse(w, "Not allowed to view the audit log", 403)
+		return
+	}
+
+	params := r.URL.Query()
+	q := &AuditQuery{
+		AppID:     params.Get("app"),
+		Secret:    params.Get("secret"),
+		Principal: params.Get("principal"),
+		Action:    params.Get("action"),
+		Limit:     100,
+	}
+
+	if since := params.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			ErrorResponse(w, "Invalid since, expected an RFC 3339 time", 400)
+			return
+		}
+		q.Since = t
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			ErrorResponse(w, "Invalid limit", 400)
+			return
+		}
+		q.Limit = n
+	}
+
+	entries, err := G.Audit.Query(q)
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, err.Error(), 500)
+		return
+	}
+
+	writeJSON(w, entries)
+}
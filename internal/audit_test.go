@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRequestBody(t *testing.T) {
+	testGlobal(t)
+	audit, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantStatus int
+	}{
+		{"small", []byte(`{"image":"app","env":["TOKEN=hunter2"]}`), 200},
+		{"at the limit", bytes.Repeat([]byte(" "), maxAuditedBodySize), 200},
+		{"too large", bytes.Repeat([]byte(" "), maxAuditedBodySize+1), 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			handled := false
+			target := auditTarget{action: "app.put", appID: "app", request: true, snapshot: func() interface{} { return nil }}
+
+			w := httptest.NewRecorder()
+			audit.audit(w, httptest.NewRequest("POST", "/admin/app", bytes.NewReader(tt.body)), target, func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				got, _ = ioutil.ReadAll(r.Body)
+			})
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if handled != (tt.wantStatus == 200) {
+				t.Fatalf("handler called = %v", handled)
+			}
+			if handled && !bytes.Equal(got, tt.body) {
+				t.Errorf("handler read %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+
+	// The recorded request has environment values redacted
+	b, err := ioutil.ReadFile(audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "hunter2") || !strings.Contains(string(b), "TOKEN=[redacted]") {
+		t.Errorf("audit log: %s", b)
+	}
+}
@@ -0,0 +1,200 @@
+package internal
+
+// caddy_ingress.go
+// CaddyIngress configures a Caddy server through its JSON admin API. Each app gets a route
+// matching <id>.<domain> and its custom domains, which proxies to this server. Caddy obtains
+// certificates for the hosts by itself, so apps are served over HTTPS. Routes are changed
+// directly through the API, so there is nothing to reload
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type CaddyIngress struct {
+	AdminURL string   // Address of Caddy's admin API, like http://localhost:2019
+	Server   string   // Name of the Caddy HTTP server the routes are added to
+	Listen   []string // Addresses the server listens on if it has to be created
+	Upstream string   // Address Caddy reaches this server at
+	Domain   string   // Apps are served at <id>.<Domain>
+
+	client *http.Client
+}
+
+// Connects to the admin API and creates the HTTP server if it doesn't exist yet
+func NewCaddyIngress(adminURL, server string, listen []string, upstream, domain string) (*CaddyIngress, error) {
+	if _, err := url.Parse(adminURL); err != nil {
+		return nil, err
+	}
+	c := &CaddyIngress{
+		AdminURL: strings.TrimSuffix(adminURL, "/"),
+		Server:   server,
+		Listen:   listen,
+		Upstream: upstream,
+		Domain:   domain,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := c.ensureServer(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sends a request to the admin API. A 404 is reported as found == false instead of an error
+func (c *CaddyIngress) request(method, path string, body interface{}, out interface{}) (found bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.AdminURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return false, errors.New("Caddy admin API returned " + resp.Status + " for " + method + " " + path + ": " + strings.TrimSpace(string(b)))
+	}
+	if out != nil && len(b) > 0 {
+		return true, json.Unmarshal(b, out)
+	}
+	return true, nil
+}
+
+// Creates each level of the config down to the server, since the admin API can't create
+// objects whose parents don't exist
+func (c *CaddyIngress) ensureServer() error {
+	server := map[string]interface{}{
+		"listen": c.Listen,
+		"routes": []interface{}{},
+	}
+	servers := map[string]interface{}{c.Server: server}
+	httpApp := map[string]interface{}{"servers": servers}
+	apps := map[string]interface{}{"http": httpApp}
+	levels := []struct {
+		path  string
+		value interface{}
+	}{
+		{"/config/", map[string]interface{}{"apps": apps}},
+		{"/config/apps", apps},
+		{"/config/apps/http", httpApp},
+		{"/config/apps/http/servers", servers},
+		{"/config/apps/http/servers/" + c.Server, server},
+	}
+
+	for i, level := range levels {
+		var current json.RawMessage
+		if _, err := c.request("GET", level.path, nil, &current); err != nil {
+			return err
+		}
+		if len(current) > 0 && string(current) != "null" {
+			continue
+		}
+		// Missing config comes back as null. Creating this level with its children is enough
+		if i == 0 {
+			_, err := c.request("POST", level.path, level.value, nil)
+			return err
+		}
+		_, err := c.request("PUT", level.path, level.value, nil)
+		return err
+	}
+	return nil
+}
+
+func caddyRouteID(app *App) string {
+	return "paas-" + app.ID
+}
+
+// Builds the route for an app
+func (c *CaddyIngress) route(app *App, hosts []string) map[string]interface{} {
+	proxy := map[string]interface{}{
+		"handler":   "reverse_proxy",
+		"upstreams": []interface{}{map[string]interface{}{"dial": c.Upstream}},
+		"headers": map[string]interface{}{
+			"request": map[string]interface{}{
+				"set": map[string]interface{}{
+					// The app is served at the root of its hosts
+					"X-Forwarded-Prefix": []string{"/"},
+				},
+			},
+		},
+	}
+	if isHTTP2(app.Protocol) {
+		// gRPC needs HTTP/2 to this server, which accepts h2c
+		proxy["transport"] = map[string]interface{}{
+			"protocol": "http",
+			"versions": []string{"h2c", "2"},
+		}
+	}
+
+	return map[string]interface{}{
+		"@id":   caddyRouteID(app),
+		"match": []interface{}{map[string]interface{}{"host": hosts}},
+		// The Host header is passed on, so the server routes the request to the app by its host
+		// and serves it at the root. Adding the /app/<id> prefix would reach the app as part of the path
+		"handle":   []interface{}{proxy},
+		"terminal": true,
+	}
+}
+
+// Adds or replaces the app's route, returning the https URL of its first host
+func (c *CaddyIngress) Write(app *App) (string, error) {
+	var hosts []string
+	if c.Domain != "" {
+		hosts = append(hosts, app.ID+"."+c.Domain)
+	}
+	hosts = append(hosts, app.Domains...)
+	if len(hosts) == 0 {
+		return "", errors.New("The app needs a domain to be served by Caddy")
+	}
+
+	route := c.route(app, hosts)
+
+	// Replace the route if the app already has one, such as from before a restart
+	found, err := c.request("PATCH", "/id/"+caddyRouteID(app), route, nil)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		if _, err := c.request("POST", "/config/apps/http/servers/"+c.Server+"/routes", route, nil); err != nil {
+			return "", err
+		}
+	}
+
+	return "https://" + hosts[0], nil
+}
+
+// Deletes the app's route
+func (c *CaddyIngress) Remove(app *App) error {
+	_, err := c.request("DELETE", "/id/"+caddyRouteID(app), nil, nil)
+	return err
+}
+
+// Routes take effect as soon as they are written
+func (*CaddyIngress) Reload() error { return nil }
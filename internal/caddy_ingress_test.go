@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockCaddy is an in-memory stand-in for Caddy's admin API. The config exists down to the
+// first `levels` levels of the server path, and routes are addressed by their @id
+type mockCaddy struct {
+	mu       sync.Mutex
+	levels   int
+	routes   map[string]map[string]interface{}
+	requests []string
+}
+
+var mockCaddyLevels = []string{"/config/", "/config/apps", "/config/apps/http", "/config/apps/http/servers", "/config/apps/http/servers/paas"}
+
+func (m *mockCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, r.Method+" "+r.URL.Path)
+
+	var body map[string]interface{}
+	if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	if r.Method == "GET" {
+		for i, path := range mockCaddyLevels {
+			if path == r.URL.Path {
+				if i < m.levels {
+					_, _ = w.Write([]byte("{}"))
+				} else {
+					_, _ = w.Write([]byte("null"))
+				}
+				return
+			}
+		}
+	}
+	if r.Method == "POST" && r.URL.Path == "/config/apps/http/servers/paas/routes" {
+		if m.levels < len(mockCaddyLevels) {
+			http.Error(w, "server does not exist", 400)
+			return
+		}
+		m.routes[body["@id"].(string)] = body
+		return
+	}
+	if r.Method == "POST" || r.Method == "PUT" {
+		for i, path := range mockCaddyLevels {
+			if path == r.URL.Path {
+				// Like Caddy, a level can only be created below an existing one
+				if i > m.levels {
+					http.Error(w, "parent does not exist", 400)
+					return
+				}
+				m.levels = len(mockCaddyLevels)
+				return
+			}
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/id/") {
+		id := strings.TrimPrefix(r.URL.Path, "/id/")
+		if _, ok := m.routes[id]; !ok {
+			http.Error(w, "unknown object ID", 404)
+			return
+		}
+		switch r.Method {
+		case "PATCH":
+			m.routes[id] = body
+		case "DELETE":
+			delete(m.routes, id)
+		}
+		return
+	}
+	http.Error(w, "unexpected request", 400)
+}
+
+func (m *mockCaddy) take() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requests := m.requests
+	m.requests = nil
+	return requests
+}
+
+func TestCaddyIngressEnsureServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels int
+		create string // Request creating the missing config, if any
+	}{
+		{"empty config", 0, "POST /config/"},
+		{"no http app", 2, "PUT /config/apps/http"},
+		{"no server", 4, "PUT /config/apps/http/servers/paas"},
+		{"existing server", 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockCaddy{levels: tt.levels, routes: make(map[string]map[string]interface{})}
+			srv := httptest.NewServer(mock)
+			defer srv.Close()
+
+			if _, err := NewCaddyIngress(srv.URL, "paas", []string{":443"}, "localhost:3000", "apps.example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if mock.levels != len(mockCaddyLevels) {
+				t.Fatalf("server was not created, requests: %q", mock.take())
+			}
+			var creates []string
+			for _, req := range mock.take() {
+				if !strings.HasPrefix(req, "GET ") {
+					creates = append(creates, req)
+				}
+			}
+			if tt.create == "" && len(creates) != 0 || tt.create != "" && (len(creates) != 1 || creates[0] != tt.create) {
+				t.Errorf("config created with %q, want %q", creates, tt.create)
+			}
+		})
+	}
+}
+
+func TestCaddyIngressRoutes(t *testing.T) {
+	mock := &mockCaddy{levels: len(mockCaddyLevels), routes: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	c, err := NewCaddyIngress(srv.URL, "paas", []string{":443"}, "localhost:3000", "apps.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.take()
+
+	app := &App{ID: "app", Domains: []string{"www.example.com"}}
+
+	// A new app's route doesn't exist, so the PATCH fails and the route is added instead
+	u, err := c.Write(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://app.apps.example.com" {
+		t.Errorf("Write returned %q", u)
+	}
+	if got := strings.Join(mock.take(), ", "); got != "PATCH /id/paas-app, POST /config/apps/http/servers/paas/routes" {
+		t.Errorf("first Write sent %s", got)
+	}
+
+	route, ok := mock.routes["paas-app"]
+	if !ok {
+		t.Fatal("route was not added")
+	}
+	b, _ := json.Marshal(route)
+	if !strings.Contains(string(b), `"host":["app.apps.example.com","www.example.com"]`) {
+		t.Errorf("route doesn't match the app's hosts: %s", b)
+	}
+	// The route must not rewrite the path, since the server already serves the app at the root of its hosts
+	handle := route["handle"].([]interface{})
+	if len(handle) != 1 || handle[0].(map[string]interface{})["handler"] != "reverse_proxy" {
+		t.Errorf("route should only proxy: %s", b)
+	}
+
+	// An existing route is replaced in place
+	if _, err := c.Write(app); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(mock.take(), ", "); got != "PATCH /id/paas-app" {
+		t.Errorf("second Write sent %s", got)
+	}
+
+	if err := c.Remove(app); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(mock.take(), ", "); got != "DELETE /id/paas-app" {
+		t.Errorf("Remove sent %s", got)
+	}
+	if _, ok := mock.routes["paas-app"]; ok {
+		t.Error("route was not deleted")
+	}
+
+	// Removing an app without a route is not an error
+	if err := c.Remove(app); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,132 @@
+package internal
+
+// container_security.go
+// Hardening applied to app containers. The server provides defaults, which individual apps
+// may override. Only admins may create apps with settings weaker than the server defaults
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const profileUnconfined = "unconfined"
+
+// ContainerSecurity describes how an app container is locked down
+type ContainerSecurity struct {
+	User            string `json:"user"`            // user[:group] the app runs as. Empty runs as the image's user
+	CapDropAll      bool   `json:"capDropAll"`      // Drop every Linux capability
+	NoNewPrivileges bool   `json:"noNewPrivileges"` // Prevent processes from gaining privileges, such as through setuid binaries
+	ReadOnlyRootfs  bool   `json:"readOnlyRootfs"`  // Mount the root filesystem read-only, with a writable tmpfs at /tmp
+	SeccompProfile  string `json:"seccompProfile"`  // Name of a seccomp profile in the server's profile directory, or "unconfined"
+	AppArmorProfile string `json:"apparmorProfile"` // Name of an AppArmor profile loaded on the host, or "unconfined"
+}
+
+// containerSecurityRequest overrides the server defaults for a single app.
+// Fields which are not set keep the default
+type containerSecurityRequest struct {
+	User            *string `json:"user"`
+	CapDropAll      *bool   `json:"capDropAll"`
+	NoNewPrivileges *bool   `json:"noNewPrivileges"`
+	ReadOnlyRootfs  *bool   `json:"readOnlyRootfs"`
+	SeccompProfile  *string `json:"seccompProfile"`
+	AppArmorProfile *string `json:"apparmorProfile"`
+}
+
+// Applies the overrides requested for an app to the defaults
+func (req *containerSecurityRequest) apply(defaults ContainerSecurity) ContainerSecurity {
+	s := defaults
+	if req == nil {
+		return s
+	}
+	if req.User != nil {
+		s.User = *req.User
+	}
+	if req.CapDropAll != nil {
+		s.CapDropAll = *req.CapDropAll
+	}
+	if req.NoNewPrivileges != nil {
+		s.NoNewPrivileges = *req.NoNewPrivileges
+	}
+	if req.ReadOnlyRootfs != nil {
+		s.ReadOnlyRootfs = *req.ReadOnlyRootfs
+	}
+	if req.SeccompProfile != nil {
+		s.SeccompProfile = *req.SeccompProfile
+	}
+	if req.AppArmorProfile != nil {
+		s.AppArmorProfile = *req.AppArmorProfile
+	}
+	return s
+}
+
+// An empty user runs as the image's user, which is usually root
+func isRootUser(user string) bool {
+	name := strings.SplitN(user, ":", 2)[0]
+	return name == "" || name == "root" || name == "0"
+}
+
+// Indicates whether these settings may be less restrictive than the defaults. There is no
+// telling whether one profile is stricter than another, so any other profile counts as weaker
+func (s ContainerSecurity) weakerThan(defaults ContainerSecurity) bool {
+	return (isRootUser(s.User) && !isRootUser(defaults.User)) ||
+		(!s.CapDropAll && defaults.CapDropAll) ||
+		(!s.NoNewPrivileges && defaults.NoNewPrivileges) ||
+		(!s.ReadOnlyRootfs && defaults.ReadOnlyRootfs) ||
+		s.SeccompProfile != defaults.SeccompProfile ||
+		s.AppArmorProfile != defaults.AppArmorProfile
+}
+
+// Checks that the named seccomp profile exists
+func (s ContainerSecurity) validate() error {
+	if s.SeccompProfile == "" || s.SeccompProfile == profileUnconfined {
+		return nil
+	}
+	_, err := seccompProfilePath(s.SeccompProfile)
+	return err
+}
+
+// Profiles are referenced by name so that apps can't make the server read arbitrary files
+func seccompProfilePath(name string) (string, error) {
+	if G.SeccompProfileDir == "" {
+		return "", errors.New("No seccomp profile directory is configured")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", errors.New("Invalid seccomp profile name: " + name)
+	}
+	file := filepath.Join(G.SeccompProfileDir, name+".json")
+	if _, err := ioutil.ReadFile(file); err != nil {
+		return "", errors.New("Unknown seccomp profile: " + name)
+	}
+	return file, nil
+}
+
+// Docker security options for these settings. The docker API expects the contents of
+// a seccomp profile rather than a path, so the profile is read here
+func (s ContainerSecurity) securityOpts() ([]string, error) {
+	var opts []string
+
+	if s.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges:true")
+	}
+
+	if s.SeccompProfile == profileUnconfined {
+		opts = append(opts, "seccomp=unconfined")
+	} else if s.SeccompProfile != "" {
+		file, err := seccompProfilePath(s.SeccompProfile)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, "seccomp="+string(b))
+	}
+
+	if s.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+s.AppArmorProfile)
+	}
+
+	return opts, nil
+}
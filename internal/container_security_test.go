@@ -0,0 +1,45 @@
+package internal
+
+import "testing"
+
+func TestContainerSecurityWeakerThan(t *testing.T) {
+	defaults := ContainerSecurity{
+		User:            "1000:1000",
+		CapDropAll:      true,
+		NoNewPrivileges: true,
+		ReadOnlyRootfs:  true,
+		SeccompProfile:  "default",
+		AppArmorProfile: "docker-default",
+	}
+	with := func(change func(s *ContainerSecurity)) ContainerSecurity {
+		s := defaults
+		change(&s)
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		security ContainerSecurity
+		want     bool
+	}{
+		{"defaults", defaults, false},
+		{"other user", with(func(s *ContainerSecurity) { s.User = "2000" }), false},
+		{"root", with(func(s *ContainerSecurity) { s.User = "root" }), true},
+		{"image user", with(func(s *ContainerSecurity) { s.User = "" }), true},
+		{"capabilities", with(func(s *ContainerSecurity) { s.CapDropAll = false }), true},
+		{"new privileges", with(func(s *ContainerSecurity) { s.NoNewPrivileges = false }), true},
+		{"writable rootfs", with(func(s *ContainerSecurity) { s.ReadOnlyRootfs = false }), true},
+		{"unconfined seccomp", with(func(s *ContainerSecurity) { s.SeccompProfile = profileUnconfined }), true},
+		{"other seccomp profile", with(func(s *ContainerSecurity) { s.SeccompProfile = "permissive" }), true},
+		{"no seccomp profile", with(func(s *ContainerSecurity) { s.SeccompProfile = "" }), true},
+		{"unconfined apparmor", with(func(s *ContainerSecurity) { s.AppArmorProfile = profileUnconfined }), true},
+		{"other apparmor profile", with(func(s *ContainerSecurity) { s.AppArmorProfile = "permissive" }), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.security.weakerThan(defaults); got != tt.want {
+				t.Errorf("weakerThan = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
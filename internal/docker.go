@@ -5,15 +5,20 @@ package internal
 // This serves as a wrapper around the docker API so that this
 // app server's API can abstract most of the details of the container
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/robfig/cron/v3"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -21,12 +26,25 @@ type DockerContainerRunner struct {
 	appID    string
 	dockerID string
 
-	Image      string   `json:"Image"`      // Name of the image to use when creating this container
-	Cmd        []string `json:"Cmd"`        // Command to execute when starting the container
-	DockerName string   `json:"DockerName"` // Unique name of the container. Should match the ID in most cases
-	Dir        string   `json:"Dir"`        // Directory of the app files on the server
-	Env        []string `json:"Env"`        // Any environment variables
-	IsRunning  bool     `json:"isRunning"`  // Indicates whether this docker container is running
+	Image       string   `json:"Image"`       // Name of the image to use when creating this container
+	Cmd         []string `json:"Cmd"`         // Command to execute when starting the container
+	DockerName  string   `json:"DockerName"`  // Unique name of the container. Should match the ID in most cases
+	Dir         string   `json:"Dir"`         // Directory of the app files on the server
+	ReadOnlyDir bool     `json:"readOnlyDir"` // Mount Dir read-only
+	Env         []string `json:"-"`           // Any environment variables. Only their names are shown
+	IsRunning   bool     `json:"isRunning"`   // Indicates whether this docker container is running
+
+	Protocol      string `json:"protocol"`      // Protocol spoken by the app on port 8080: http, h2c, h2, tcp, or udp
+	TLSSkipVerify bool   `json:"tlsSkipVerify"` // Skip verification of the container's certificate for h2 upstreams
+	MTLS          bool   `json:"mtls"`          // Use mutual TLS with certificates from the internal CA
+
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"` // Time to wait for response headers from the app
+
+	Security ContainerSecurity `json:"security"` // Hardening applied to the container
+
+	// Environment variables set from secrets, mapping the variable to the secret's name.
+	// The values are looked up each time the container is created
+	Secrets map[string]string `json:"secrets"`
 
 	jobs       *cron.Cron
 	jobHandles map[string]cron.EntryID
@@ -44,6 +62,7 @@ func NewDockerContainer(appID, image, dockerName, dir string, cmd, env []string)
 		DockerName: dockerName,
 		Dir:        dir,
 		Env:        env,
+		Protocol:   ProtocolHTTP,
 		backendURL: "http://" + dockerName + ":8080",
 		jobs:       cron.New(),
 		jobHandles: make(map[string]cron.EntryID),
@@ -112,12 +131,32 @@ func (d *DockerContainerRunner) Create() error {
 
 	d.jobs.Start()
 
+	d.backendURL = upstreamScheme(d.Protocol, d.MTLS) + "://" + d.DockerName + ":8080"
 	u, err := url.Parse(d.backendURL)
 	if err != nil {
 		return err
 	}
 
+	var tlsConfig *tls.Config
+	if d.MTLS {
+		if tlsConfig, err = G.InternalCA.ClientTLSConfig(d.DockerName); err != nil {
+			return err
+		}
+	} else if d.Protocol == ProtocolH2 {
+		tlsConfig = &tls.Config{
+			ServerName:         d.DockerName,
+			InsecureSkipVerify: d.TLSSkipVerify,
+		}
+	}
+
 	d.proxy = httputil.NewSingleHostReverseProxy(u)
+	d.proxy.ErrorHandler = proxyErrorHandler
+	d.proxy.ModifyResponse = setAppHeaders
+	d.proxy.Transport = withResponseHeaderTimeout(newUpstreamTransport(d.Protocol, tlsConfig), time.Duration(d.ResponseHeaderTimeout))
+	if isHTTP2(d.Protocol) {
+		// Streaming calls need every message flushed to the client as soon as it arrives
+		d.proxy.FlushInterval = -1
+	}
 
 	return nil
 }
@@ -148,6 +187,13 @@ func (d *DockerContainerRunner) Cleanup() error {
 	return nil
 }
 
+// StopJobs stops the health check and inactivity jobs but leaves the container as it is.
+// Used when the server shuts down without removing its apps
+func (d *DockerContainerRunner) StopJobs() {
+	d.jobs.Stop()
+	d.jobHandles = make(map[string]cron.EntryID)
+}
+
 func (d *DockerContainerRunner) IsReady() bool {
 	return d.IsRunning
 }
@@ -162,6 +208,24 @@ func (d *DockerContainerRunner) Invoke(w http.ResponseWriter, r *http.Request) {
 	d.proxy.ServeHTTP(w, r)
 }
 
+// MarshalJSON shows only the names of the environment variables, since their values may be
+// secrets passed as plain variables. Variables set from secrets are listed with Secrets
+func (d *DockerContainerRunner) MarshalJSON() ([]byte, error) {
+	type runner DockerContainerRunner
+	names := make([]string, len(d.Env))
+	for i, v := range d.Env {
+		names[i] = strings.SplitN(v, "=", 2)[0]
+	}
+	return json.Marshal(&struct {
+		*runner
+		EnvNames []string `json:"envNames"`
+	}{(*runner)(d), names})
+}
+
+func (d *DockerContainerRunner) Addr() string {
+	return d.DockerName + ":8080"
+}
+
 func (d *DockerContainerRunner) run() error {
 	err := d.create()
 	if err != nil {
@@ -178,21 +242,77 @@ func (d *DockerContainerRunner) run() error {
 
 func (d *DockerContainerRunner) create() error {
 	ctx := context.Background()
-	dockerResp, err := G.Docker.ContainerCreate(ctx,
-		&container.Config{
-			Env:        d.Env,
-			Image:      d.Image,
-			Cmd:        d.Cmd,
-			Entrypoint: []string{"docker-entrypoint.sh"},
-		}, &container.HostConfig{
-			Binds: []string{
-				d.Dir + ":/home/app",
-			},
-		}, nil, nil, d.DockerName)
+
+	var binds []string
+	if d.Dir != "" {
+		// Checked again on every create, since a directory on the path may have been replaced
+		// with a symlink leading outside the allowed directories after the app was created
+		dir, err := resolveMountDir(d.Dir)
+		if err != nil {
+			return errors.New("Could not mount " + d.Dir + ": " + err.Error())
+		}
+		bind := dir + ":/home/app"
+		if d.ReadOnlyDir {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
+	}
+
+	env := d.Env
+	if len(d.Secrets) > 0 {
+		secretEnv, err := G.Secrets.environment(d.Secrets)
+		if err != nil {
+			return err
+		}
+		env = append(append([]string{}, d.Env...), secretEnv...)
+	}
+
+	securityOpts, err := d.Security.securityOpts()
+	if err != nil {
+		return err
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds:          binds,
+		SecurityOpt:    securityOpts,
+		ReadonlyRootfs: d.Security.ReadOnlyRootfs,
+	}
+	if d.Security.CapDropAll {
+		hostConfig.CapDrop = strslice.StrSlice{"ALL"}
+	}
+	if d.Security.ReadOnlyRootfs {
+		hostConfig.Tmpfs = map[string]string{"/tmp": "rw,noexec,nosuid,size=64m"}
+	}
+
+	config := &container.Config{
+		Env:        env,
+		Image:      d.Image,
+		Cmd:        d.Cmd,
+		User:       d.Security.User,
+		Entrypoint: []string{"docker-entrypoint.sh"},
+	}
+	if d.MTLS {
+		// The certificates are copied into a volume, since the root filesystem may be read-only
+		config.Volumes = map[string]struct{}{appCertDir: {}}
+		config.Env = append(append([]string{}, env...),
+			"PAAS_TLS_CERT="+appCertDir+"/tls.crt",
+			"PAAS_TLS_KEY="+appCertDir+"/tls.key",
+			"PAAS_TLS_CA="+appCertDir+"/ca.crt",
+		)
+	}
+
+	dockerResp, err := G.Docker.ContainerCreate(ctx, config, hostConfig, nil, nil, d.DockerName)
 	if err != nil {
 		return errors.New("Could not create docker container")
 	}
 
+	if d.MTLS {
+		if err := d.copyCertificates(ctx, dockerResp.ID); err != nil {
+			_ = G.Docker.ContainerRemove(ctx, dockerResp.ID, types.ContainerRemoveOptions{RemoveVolumes: true})
+			return err
+		}
+	}
+
 	if err := G.Docker.NetworkConnect(ctx, G.DockerNetwork, dockerResp.ID, &network.EndpointSettings{}); err != nil {
 		_ = G.Docker.ContainerStop(ctx, dockerResp.ID, nil)
 		return errors.New("Could not connect container to network")
@@ -203,6 +323,21 @@ func (d *DockerContainerRunner) create() error {
 	return nil
 }
 
+// Issues a certificate for the container and copies it into the certificate directory,
+// owned by the container's user
+func (d *DockerContainerRunner) copyCertificates(ctx context.Context, dockerID string) error {
+	archive, err := G.InternalCA.AppCertArchive(d.DockerName)
+	if err != nil {
+		return err
+	}
+
+	if err := G.Docker.CopyToContainer(ctx, dockerID, appCertDir, bytes.NewReader(archive),
+		types.CopyToContainerOptions{CopyUIDGID: true}); err != nil {
+		return errors.New("Could not copy certificates to docker container")
+	}
+	return nil
+}
+
 func (d *DockerContainerRunner) start() error {
 	ctx := context.Background()
 
@@ -237,7 +372,8 @@ func (d *DockerContainerRunner) stop() error {
 func (d *DockerContainerRunner) remove() error {
 	ctx := context.Background()
 
-	if err := G.Docker.ContainerRemove(ctx, d.dockerID, types.ContainerRemoveOptions{}); err != nil {
+	// Removes the certificate volume of mtls containers along with them
+	if err := G.Docker.ContainerRemove(ctx, d.dockerID, types.ContainerRemoveOptions{RemoveVolumes: d.MTLS}); err != nil {
 		return errors.New("Could not remove container")
 	}
 
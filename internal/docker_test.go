@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDockerContainerRunnerHidesEnvValues(t *testing.T) {
+	d := NewDockerContainer("app", "image", "app", "", nil, []string{"DATABASE_URL=postgres://user:hunter2@db", "DEBUG=1", "EMPTY"})
+	d.Secrets = map[string]string{"API_TOKEN": "api-token"}
+
+	b, err := json.Marshal(&App{ID: "app", Runner: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"hunter2", "postgres://", "DEBUG=1"} {
+		if strings.Contains(string(b), value) {
+			t.Errorf("%q leaked in %s", value, b)
+		}
+	}
+
+	out := &struct {
+		Runner struct {
+			Env      []string          `json:"Env"`
+			EnvNames []string          `json:"envNames"`
+			Image    string            `json:"Image"`
+			Secrets  map[string]string `json:"secrets"`
+		} `json:"runner"`
+	}{}
+	if err := json.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(out.Runner.EnvNames, ",") != "DATABASE_URL,DEBUG,EMPTY" {
+		t.Errorf("envNames = %q", out.Runner.EnvNames)
+	}
+	if out.Runner.Env != nil {
+		t.Errorf("Env = %q", out.Runner.Env)
+	}
+	// The rest of the runner is still shown
+	if out.Runner.Image != "image" || out.Runner.Secrets["API_TOKEN"] != "api-token" {
+		t.Errorf("runner fields missing from %s", b)
+	}
+}
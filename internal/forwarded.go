@@ -0,0 +1,135 @@
+package internal
+
+// forwarded.go
+// Handling of the X-Forwarded-* headers. Headers sent by a client can't be trusted, since
+// anyone can claim to be forwarding a request for someone else. The values are only used
+// when the request arrives from one of the configured trusted proxies, such as the nginx
+// ingress, and are otherwise replaced with what the server observed itself
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Parses a comma-separated list of CIDRs. Plain IP addresses are treated as single hosts
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address: " + s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = s + "/" + strconv.Itoa(bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range G.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP address of the peer connected to the server, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Indicates whether the request was received directly from a trusted proxy
+func fromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(net.ParseIP(remoteIP(r)))
+}
+
+// Resolves the address of the client which sent the request. X-Forwarded-For is walked from
+// the right, skipping trusted proxies, so the first untrusted address is the client.
+// A client can prepend anything to the header, but can't forge entries added by trusted proxies
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		parsed := net.ParseIP(hop)
+		if parsed == nil {
+			// Anything left of a malformed entry can't be trusted either
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(parsed) {
+			break
+		}
+	}
+	return ip
+}
+
+// Sets the X-Forwarded-* headers on a request proxied to an app. prefix is the path prefix
+// removed from the request, which is passed to the app as X-Forwarded-Prefix so that it
+// can build absolute links. The reverse proxy appends the peer address to X-Forwarded-For
+func setForwardedHeaders(out, in *http.Request, prefix string) {
+	trusted := fromTrustedProxy(in)
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	host := in.Host
+
+	if trusted {
+		if p := in.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+		if h := in.Header.Get("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+		// A trusted proxy which rewrote the path knows the prefix the client used. "/" means the root
+		if p := in.Header.Get("X-Forwarded-Prefix"); p != "" {
+			prefix = strings.TrimSuffix(p, "/")
+		}
+	} else {
+		out.Header.Del("X-Forwarded-For")
+	}
+
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", host)
+	if prefix != "" {
+		out.Header.Set("X-Forwarded-Prefix", prefix)
+	} else {
+		out.Header.Del("X-Forwarded-Prefix")
+	}
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	g := testGlobal(t)
+	var err error
+	if g.TrustedProxies, err = parseCIDRs("10.0.0.0/8, 192.168.1.1, fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string // X-Forwarded-For headers, in order
+		want   string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:80", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"trusted proxy without header", "10.0.0.2:80", nil, "10.0.0.2"},
+		{"chain of trusted proxies", "10.0.0.2:80", []string{"203.0.113.7, 192.168.1.1, 10.1.1.1"}, "203.0.113.7"},
+		{"spoofed entries left of the client", "10.0.0.2:80", []string{"1.2.3.4, 10.9.9.9, 203.0.113.7"}, "203.0.113.7"},
+		{"spoofed trusted address left of the client", "10.0.0.2:80", []string{"10.9.9.9, 203.0.113.7, 10.1.1.1"}, "203.0.113.7"},
+		{"headers split across lines", "10.0.0.2:80", []string{"1.2.3.4", "203.0.113.7, 10.1.1.1"}, "203.0.113.7"},
+		{"malformed entry stops the walk", "10.0.0.2:80", []string{"203.0.113.7, garbage, 10.1.1.1"}, "10.1.1.1"},
+		{"only trusted hops", "10.0.0.2:80", []string{"10.1.1.1, 192.168.1.1"}, "10.1.1.1"},
+		{"single trusted host", "192.168.1.1:80", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"neighbor of the trusted host", "192.168.1.2:80", []string{"203.0.113.7"}, "192.168.1.2"},
+		{"ipv6 trusted proxy", "[fd00::1]:80", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"ipv6 client", "[2001:db8::7]:1234", []string{"203.0.113.9"}, "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, h := range tt.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package internal
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"github.com/docker/docker/client"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
 	"os"
 	"sync"
 	"time"
@@ -16,11 +21,55 @@ type Global struct {
 	Docker *client.Client
 
 	Addr          string
+	TLSAddr       string // Address of the TLS listener, used when certificates are configured
+	TLSRedirect   bool   // Redirect requests on Addr to TLSAddr
+	ACMEHTTPAddr  string // Address of a listener answering ACME HTTP-01 challenges, besides Addr. Empty means none
 	StopTimeout   time.Duration
 	StartTimeout  time.Duration
 	DockerNetwork string
+	AppDomain     string // Apps are served at <id>.<AppDomain> when set
+
+	// Hostnames of the server itself, such as the one its admin routes are reached at. Apps can't claim them
+	ServerHosts []string
+
+	// Proxies whose X-Forwarded-* headers are trusted when resolving the client address
+	TrustedProxies []*net.IPNet
+
+	// Timeouts for connections to the server. 0 means no timeout
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	DrainTimeout   time.Duration // Time allowed for requests in flight to finish when shutting down
+	KeepContainers bool          // Leave app containers running when the server shuts down
 
 	Ingress IngressServer
+	Streams *StreamIngress // Serves tcp and udp apps, whichever ingress serves HTTP apps
+
+	AdminAuth *AdminAuth
+
+	// Canonical base directories which app directories may be mounted from
+	MountAllow []string
+
+	ImagePolicy *ImagePolicy
+
+	// Hardening applied to app containers unless the app overrides it
+	ContainerSecurity ContainerSecurity
+	SeccompProfileDir string
+
+	Secrets *SecretStore
+
+	Audit *AuditLog
+
+	// Keys used to verify JWTs for apps using jwt authentication
+	JWKS *JWKS
+
+	// Certificates served by the TLS listener
+	Certs *CertStore
+
+	// Issues the certificates used for mutual TLS with app containers
+	InternalCA *InternalCA
 }
 
 // Parse all arguments. Passed arguments take precedence over environment variables
@@ -30,7 +79,103 @@ func FromEnv() (*Global, error) {
 	containerStartTimeout := flag.String("start-timeout", "15s", "Amount of time to wait for a container to start")
 	dockerNetwork := flag.String("network", "app-network", "Name of the docker network the app containers are placed in. "+
 		"This will be moved into runner-specific configuration soon.")
-	useNginx := flag.Bool("nginx", false, "Indicates whether the program will run behind an nginx proxy")
+	tlsAddr := flag.String("tls-addr", "", "Address used to listen for TLS connections when a certificate is configured "+
+		"(default :3443)")
+	tlsCert := flag.String("tls-cert", "", "Default TLS certificate file. The file is re-read when it changes")
+	tlsKey := flag.String("tls-key", "", "Key file for the default TLS certificate")
+	tlsCertDir := flag.String("tls-cert-dir", "", "Directory of certificates selected by SNI, stored as <hostname>.crt and "+
+		"<hostname>.key. Wildcard certificates are stored as _.<domain>.crt. Files are re-read when they change")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL used to obtain certificates for app domains, "+
+		"for example https://acme-v02.api.letsencrypt.org/directory. ACME is disabled when empty")
+	acmeDir := flag.String("acme-dir", "", "Directory ACME certificates and the account key are stored in (default acme)")
+	acmeEmail := flag.String("acme-email", "", "Contact email registered with the ACME CA")
+	acmeCARoot := flag.String("acme-ca-root", "", "PEM file of additional CA certificates trusted when connecting to the ACME "+
+		"directory, such as the root of a local test CA")
+	acmeHosts := flag.String("acme-hosts", "", "Comma-separated list of hosts, other than app domains, to obtain certificates for")
+	acmeHTTPAddr := flag.String("acme-http-addr", "", "Address of a listener answering ACME HTTP-01 challenges, such as :80, "+
+		"for when -addr isn't reachable on port 80. Other requests to it are redirected to HTTPS")
+	tlsRedirect := flag.Bool("tls-redirect", false, "Redirect plain HTTP requests to the TLS address")
+	serverHosts := flag.String("server-hosts", "", "Comma-separated hostnames the server's admin routes are reached at. "+
+		"Apps can't use them as domains, along with the hosts of -addr, -tls-addr, and -acme-hosts")
+	appDomain := flag.String("app-domain", "", "Domain under which each app is served at <id>.<domain>, for example apps.example.test. "+
+		"Leave empty to disable subdomain routing")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.0/8,::1", "Comma-separated list of CIDRs of proxies "+
+		"allowed to set X-Forwarded-* headers")
+	// Duration flags default to empty so the environment variables are used when the flags aren't passed
+	readTimeout := flag.String("read-timeout", "", "Maximum time to read a request, including the body (default 0s). "+
+		"Disabled by default since it would cut off uploads and streaming requests. Slow clients are bounded by -read-header-timeout")
+	readHeaderTimeout := flag.String("read-header-timeout", "", "Maximum time to read request headers (default 10s)")
+	writeTimeout := flag.String("write-timeout", "", "Maximum time to write a response (default 0s). Disabled by default since "+
+		"streaming responses may be long-lived. Use per-app timeouts to bound requests to apps")
+	idleTimeout := flag.String("idle-timeout", "", "Maximum time to keep an idle keep-alive connection open (default 2m)")
+	drainTimeout := flag.String("drain-timeout", "", "Time allowed for requests in flight to finish when shutting down (default 30s)")
+	keepContainers := flag.Bool("keep-containers", false, "Leave app containers and ingress configuration in place "+
+		"when the server shuts down, instead of stopping and removing them")
+	adminTokens := flag.String("admin-tokens", "", "File of name:token lines accepted as bearer tokens by the admin routes. "+
+		"The file is re-read when it changes")
+	adminKeys := flag.String("admin-hmac-keys", "", "File of keys, one per line, used to verify HMAC-signed admin tokens. "+
+		"The file is re-read when it changes")
+	adminInsecure := flag.Bool("admin-insecure", false, "Disable authentication for the admin routes. Only use this for local development")
+	mountAllow := flag.String("mount-allow", "", "Comma-separated list of directories which app directories may be "+
+		"mounted from. Symlinks are resolved within the server's filesystem. No directories are allowed by default")
+	imagePolicy := flag.String("image-policy", "", "Json file of rules for the images apps may use. "+
+		"The file is re-read when it changes. Every image is allowed without a policy")
+	containerUser := flag.String("container-user", "1000:1000", "Default user[:group] app containers run as. "+
+		"Set to an empty string to use the image's user")
+	capDropAll := flag.Bool("cap-drop-all", true, "Drop all Linux capabilities from app containers by default")
+	noNewPrivileges := flag.Bool("no-new-privileges", true, "Prevent processes in app containers from gaining privileges by default")
+	readOnlyRootfs := flag.Bool("read-only-rootfs", true, "Mount the root filesystem of app containers read-only by default, "+
+		"with a writable tmpfs at /tmp")
+	seccompProfile := flag.String("seccomp-profile", "", "Default seccomp profile for app containers: the name of a profile "+
+		"in -seccomp-dir, or unconfined. Empty uses docker's default profile")
+	seccompDir := flag.String("seccomp-dir", "", "Directory of seccomp profiles, stored as <name>.json")
+	apparmorProfile := flag.String("apparmor-profile", "", "Default AppArmor profile for app containers. "+
+		"Empty uses docker's default profile")
+	secretsFile := flag.String("secrets-file", "", "File the encrypted secrets are stored in (default secrets.json)")
+	secretsKeyFile := flag.String("secrets-key-file", "", "File containing the 32 byte key secrets are encrypted with, "+
+		"encoded as hex or base64. The key may also be passed in SECRETS_KEY. Secrets are disabled without a key")
+	auditLog := flag.String("audit-log", "", "File admin actions are recorded in as json lines (default audit.log)")
+	auditLogMaxSize := flag.Int64("audit-log-max-size", 10*1024*1024, "Size in bytes at which the audit log is rotated")
+	auditLogBackups := flag.Int("audit-log-backups", 5, "Number of rotated audit logs to keep")
+	jwksFile := flag.String("jwks-file", "", "JWKS file with the keys used to verify JWTs sent to apps using jwt authentication. "+
+		"The file is re-read when it changes")
+	internalCACert := flag.String("internal-ca-cert", "", "Certificate of the CA used for mutual TLS with app "+
+		"containers. The CA is created when first needed if neither file exists (default internal-ca.crt)")
+	internalCAKey := flag.String("internal-ca-key", "", "Key of the CA used for mutual TLS with app containers "+
+		"(default internal-ca.key)")
+	ingressKind := flag.String("ingress", "", "Ingress serving apps besides /app/<id>: nginx, go (a port per app served by "+
+		"this server), caddy, traefik, or haproxy. Empty means apps are only served at /app/<id>")
+	ingressUpstream := flag.String("ingress-upstream", "", "Address the caddy, traefik, and haproxy ingresses reach this "+
+		"server at. Defaults to -addr")
+	ingressTemplate := flag.String("ingress-template", "", "Template file replacing the built-in configuration template "+
+		"of the nginx, traefik, and haproxy ingresses. The file is re-read when it changes")
+	nginxMode := flag.String("nginx-mode", "", "How nginx serves apps: ports (the default), for a port per app, or hosts, for a "+
+		"virtual host per app at <id>.<app-domain> on a single port")
+	nginxPorts := flag.String("nginx-ports", "", "Range of ports nginx serves apps on in ports mode. "+
+		"The same ports must be published by the nginx container (default 5000-5099)")
+	nginxPort := flag.Int("nginx-port", 80, "Port nginx serves apps on in hosts mode")
+	nginxGRPCPort := flag.Int("nginx-grpc-port", 0, "Port nginx serves gRPC apps on in hosts mode. gRPC apps can't use "+
+		"the nginx ingress in hosts mode without it")
+	ingressPorts := flag.String("ingress-ports", "", "Range of ports the built-in ingress serves apps on (default 5000-5099)")
+	ingressHost := flag.String("ingress-host", "", "Host used in the URLs of apps served by the built-in ingress. "+
+		"Defaults to the host of -addr, or localhost")
+	streamPorts := flag.String("stream-ports", "", "Range of ports tcp and udp apps are served on (default 6000-6099)")
+	streamHost := flag.String("stream-host", "", "Host used in the URLs of tcp and udp apps. Defaults to -ingress-host")
+	caddyAdmin := flag.String("caddy-admin", "", "URL of the Caddy admin API used by the caddy ingress "+
+		"(default http://localhost:2019)")
+	caddyServer := flag.String("caddy-server", "", "Name of the Caddy HTTP server app routes are added to (default paas)")
+	caddyListen := flag.String("caddy-listen", "", "Comma-separated addresses the Caddy server listens on, if it has to be "+
+		"created (default :443)")
+	traefikDir := flag.String("traefik-dir", "", "Directory watched by Traefik's file provider, "+
+		"which the traefik ingress writes a file per app to (default /etc/traefik/dynamic)")
+	traefikEntryPoints := flag.String("traefik-entrypoints", "", "Comma-separated Traefik entry points app routers are "+
+		"attached to. Empty attaches them to every entry point")
+	haproxyDir := flag.String("haproxy-dir", "", "Directory loaded by HAProxy, which the haproxy ingress "+
+		"writes a backend per app to (default /etc/haproxy/paas)")
+	haproxyMap := flag.String("haproxy-map", "", "Map file of hosts to app backends written by the haproxy ingress "+
+		"(default /etc/haproxy/paas.map)")
+	haproxyReload := flag.String("haproxy-reload", "", "Shell command run to reload HAProxy after apps change. "+
+		"Empty means HAProxy is reloaded by something else")
 	logLevel := flag.Int("log", 0, "Log level. 0 indicates all logs, 4 indicates none")
 
 	flag.Parse()
@@ -40,6 +185,7 @@ func FromEnv() (*Global, error) {
 		stopTimeout  string = *stopTimeoutPtr
 		startTimeout string = *containerStartTimeout
 		network      string = *dockerNetwork
+		domain       string = *appDomain
 		ingress      IngressServer
 	)
 
@@ -64,6 +210,144 @@ func FromEnv() (*Global, error) {
 		network = os.Getenv("DOCKER_NETWORK")
 	}
 
+	if domain == "" {
+		domain = os.Getenv("APP_DOMAIN")
+	}
+
+	// An empty list may be passed on purpose to trust no proxies, so the environment only overrides the default
+	proxies := *trustedProxies
+	if p, ok := os.LookupEnv("TRUSTED_PROXIES"); ok && !isFlagSet("trusted-proxies") {
+		proxies = p
+	}
+
+	trustedProxyNets, err := parseCIDRs(proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	serverReadTimeout, err := parseDurationOrEnv(*readTimeout, "READ_TIMEOUT", "0s")
+	if err != nil {
+		return nil, err
+	}
+
+	serverReadHeaderTimeout, err := parseDurationOrEnv(*readHeaderTimeout, "READ_HEADER_TIMEOUT", "10s")
+	if err != nil {
+		return nil, err
+	}
+
+	serverWriteTimeout, err := parseDurationOrEnv(*writeTimeout, "WRITE_TIMEOUT", "0s")
+	if err != nil {
+		return nil, err
+	}
+
+	serverIdleTimeout, err := parseDurationOrEnv(*idleTimeout, "IDLE_TIMEOUT", "2m")
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownDrainTimeout, err := parseDurationOrEnv(*drainTimeout, "DRAIN_TIMEOUT", "30s")
+	if err != nil {
+		return nil, err
+	}
+
+	adminAuth, err := NewAdminAuth(
+		flagOrEnv(*adminTokens, "ADMIN_TOKENS_FILE"),
+		flagOrEnv(*adminKeys, "ADMIN_HMAC_KEYS_FILE"),
+		os.Getenv("ADMIN_TOKENS"),
+		os.Getenv("ADMIN_HMAC_KEYS"),
+		*adminInsecure || os.Getenv("ADMIN_INSECURE") == "1",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	mountAllowlist, err := parseMountAllowlist(flagOrEnv(*mountAllow, "MOUNT_ALLOW"))
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := NewImagePolicy(flagOrEnv(*imagePolicy, "IMAGE_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The user may be set to an empty string on purpose, so the environment only overrides the default
+	user := *containerUser
+	if u, ok := os.LookupEnv("CONTAINER_USER"); ok && !isFlagSet("container-user") {
+		user = u
+	}
+
+	security := ContainerSecurity{
+		User:            user,
+		CapDropAll:      *capDropAll,
+		NoNewPrivileges: *noNewPrivileges,
+		ReadOnlyRootfs:  *readOnlyRootfs,
+		SeccompProfile:  flagOrEnv(*seccompProfile, "SECCOMP_PROFILE"),
+		AppArmorProfile: flagOrEnv(*apparmorProfile, "APPARMOR_PROFILE"),
+	}
+
+	secretsKey := os.Getenv("SECRETS_KEY")
+	if file := flagOrEnv(*secretsKeyFile, "SECRETS_KEY_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		secretsKey = string(b)
+	}
+
+	secrets, err := NewSecretStore(flagOrEnvDefault(*secretsFile, "SECRETS_FILE", "secrets.json"), secretsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := NewAuditLog(flagOrEnvDefault(*auditLog, "AUDIT_LOG", "audit.log"), *auditLogMaxSize, *auditLogBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks, err := NewJWKS(flagOrEnv(*jwksFile, "JWKS_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	var acmeManager *autocert.Manager
+	if directory := flagOrEnv(*acmeDirectory, "ACME_DIRECTORY"); directory != "" {
+		acmeManager, err = NewACMEManager(
+			directory,
+			flagOrEnvDefault(*acmeDir, "ACME_DIR", "acme"),
+			flagOrEnv(*acmeEmail, "ACME_EMAIL"),
+			flagOrEnv(*acmeCARoot, "ACME_CA_ROOT"),
+			splitList(flagOrEnv(*acmeHosts, "ACME_HOSTS")),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	challengeAddr := flagOrEnv(*acmeHTTPAddr, "ACME_HTTP_ADDR")
+	if challengeAddr != "" && acmeManager == nil {
+		return nil, errors.New("-acme-http-addr requires -acme-directory")
+	}
+
+	tlsAddress := flagOrEnvDefault(*tlsAddr, "TLS_ADDR", ":3443")
+
+	var reservedHosts []string
+	for _, host := range append(append(splitList(flagOrEnv(*serverHosts, "SERVER_HOSTS")), addr, tlsAddress, challengeAddr, "localhost"),
+		splitList(flagOrEnv(*acmeHosts, "ACME_HOSTS"))...) {
+		if host = normalizeHost(host); host != "" {
+			reservedHosts = append(reservedHosts, host)
+		}
+	}
+
+	certs, err := NewCertStore(
+		flagOrEnv(*tlsCert, "TLS_CERT"),
+		flagOrEnv(*tlsKey, "TLS_KEY"),
+		flagOrEnv(*tlsCertDir, "TLS_CERT_DIR"),
+		acmeManager,
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	dockerStopTimeout, err := time.ParseDuration(stopTimeout)
 	if err != nil {
 		return nil, err
@@ -74,17 +358,112 @@ func FromEnv() (*Global, error) {
 		return nil, err
 	}
 
-	if *useNginx || os.Getenv("USE_NGINX") == "1" {
-		ingress = &NginxPorts{
-			NginxAppDir: "/etc/nginx/apps",
-			confMu:      &sync.Mutex{},
-			ports:       [100]bool{},
-			apps:        make(map[string]confPortEntry),
-		}
-	} else {
+	// Host of the URLs of apps served on their own port
+	publicHost := flagOrEnv(*ingressHost, "INGRESS_HOST")
+	if publicHost == "" {
+		publicHost = normalizeHost(addr)
+	}
+	if publicHost == "" {
+		publicHost = "localhost"
+	}
+
+	minStreamPort, maxStreamPort, err := parsePortRange(flagOrEnvDefault(*streamPorts, "STREAM_PORTS", "6000-6099"))
+	if err != nil {
+		return nil, err
+	}
+	streamPublicHost := flagOrEnv(*streamHost, "STREAM_HOST")
+	if streamPublicHost == "" {
+		streamPublicHost = publicHost
+	}
+
+	// Listeners of apps served on their own port bind to the same interface as the server
+	bindHost, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := flagOrEnv(*ingressUpstream, "INGRESS_UPSTREAM")
+	if upstream == "" {
+		upstream = addr
+	}
+
+	switch kind := flagOrEnv(*ingressKind, "INGRESS"); kind {
+	case "", "none":
 		ingress = &NoIngress{}
+	case "nginx":
+		switch mode := flagOrEnv(*nginxMode, "NGINX_MODE"); mode {
+		case "", "ports":
+			minPort, maxPort, err := parsePortRange(flagOrEnvDefault(*nginxPorts, "NGINX_PORTS", "5000-5099"))
+			if err != nil {
+				return nil, err
+			}
+			ingress, err = NewNginxPorts("/etc/nginx/apps", minPort, maxPort, flagOrEnv(*ingressTemplate, "INGRESS_TEMPLATE"))
+			if err != nil {
+				return nil, err
+			}
+		case "hosts":
+			ingress, err = NewNginxHosts("/etc/nginx/apps", normalizeHost(domain), *nginxPort, *nginxGRPCPort,
+				flagOrEnv(*ingressTemplate, "INGRESS_TEMPLATE"))
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("Unsupported nginx mode: " + mode)
+		}
+	case "go":
+		minPort, maxPort, err := parsePortRange(flagOrEnvDefault(*ingressPorts, "INGRESS_PORTS", "5000-5099"))
+		if err != nil {
+			return nil, err
+		}
+		// Listeners use the server's certificates
+		var tlsConfig *tls.Config
+		if certs.Enabled() {
+			tlsConfig = certs.TLSConfig()
+		}
+		ingress = NewGoIngress(publicHost, bindHost, tlsConfig, minPort, maxPort)
+	case "caddy":
+		ingress, err = NewCaddyIngress(
+			flagOrEnvDefault(*caddyAdmin, "CADDY_ADMIN", "http://localhost:2019"),
+			flagOrEnvDefault(*caddyServer, "CADDY_SERVER", "paas"),
+			splitList(flagOrEnvDefault(*caddyListen, "CADDY_LISTEN", ":443")),
+			upstream,
+			normalizeHost(domain),
+		)
+		if err != nil {
+			return nil, err
+		}
+	case "traefik":
+		ingress, err = NewTraefikIngress(
+			flagOrEnvDefault(*traefikDir, "TRAEFIK_DIR", "/etc/traefik/dynamic"),
+			normalizeHost(domain),
+			upstream,
+			splitList(flagOrEnv(*traefikEntryPoints, "TRAEFIK_ENTRYPOINTS")),
+			flagOrEnv(*ingressTemplate, "INGRESS_TEMPLATE"),
+		)
+		if err != nil {
+			return nil, err
+		}
+	case "haproxy":
+		ingress, err = NewHAProxyIngress(
+			flagOrEnvDefault(*haproxyDir, "HAPROXY_DIR", "/etc/haproxy/paas"),
+			flagOrEnvDefault(*haproxyMap, "HAPROXY_MAP", "/etc/haproxy/paas.map"),
+			normalizeHost(domain),
+			upstream,
+			flagOrEnv(*haproxyReload, "HAPROXY_RELOAD"),
+			flagOrEnv(*ingressTemplate, "INGRESS_TEMPLATE"),
+		)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unsupported ingress: " + kind)
 	}
 
+	internalCA := NewInternalCA(
+		flagOrEnvDefault(*internalCACert, "INTERNAL_CA_CERT", "internal-ca.crt"),
+		flagOrEnvDefault(*internalCAKey, "INTERNAL_CA_KEY", "internal-ca.key"),
+	)
+
 	return &Global{
 		AppMgr: &DefaultAppManager{
 			apps:  make(map[string]*App),
@@ -95,13 +474,79 @@ func FromEnv() (*Global, error) {
 			errorLog: os.Stderr,
 			level:    LogLevel(*logLevel),
 		},
-		Docker:        docker,
-		Addr:          addr,
-		StopTimeout:   dockerStopTimeout,
-		StartTimeout:  startTimeoutDuration,
-		DockerNetwork: network,
-		Ingress:       ingress,
+		Docker:         docker,
+		Addr:           addr,
+		TLSAddr:        tlsAddress,
+		TLSRedirect:    *tlsRedirect || os.Getenv("TLS_REDIRECT") == "1",
+		ACMEHTTPAddr:   challengeAddr,
+		StopTimeout:    dockerStopTimeout,
+		StartTimeout:   startTimeoutDuration,
+		DockerNetwork:  network,
+		AppDomain:      normalizeHost(domain),
+		ServerHosts:    reservedHosts,
+		TrustedProxies: trustedProxyNets,
+
+		ReadTimeout:       serverReadTimeout,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+
+		DrainTimeout:   shutdownDrainTimeout,
+		KeepContainers: *keepContainers || os.Getenv("KEEP_CONTAINERS") == "1",
+		Ingress:        ingress,
+		Streams:        NewStreamIngress(streamPublicHost, bindHost, minStreamPort, maxStreamPort),
+		AdminAuth:      adminAuth,
+		MountAllow:     mountAllowlist,
+		ImagePolicy:    policy,
+
+		ContainerSecurity: security,
+		SeccompProfileDir: flagOrEnv(*seccompDir, "SECCOMP_DIR"),
+		Secrets:           secrets,
+		Audit:             audit,
+		JWKS:              jwks,
+		Certs:             certs,
+		InternalCA:        internalCA,
 	}, nil
 }
 
+// Returns the flag value, or the environment variable if the flag is empty
+func flagOrEnv(value, env string) string {
+	if value == "" {
+		return os.Getenv(env)
+	}
+	return value
+}
+
+// Returns the flag value, or the environment variable if the flag is empty, or the default if
+// neither is set. Flags using this default to empty, so the environment variable is read when
+// the flag isn't passed
+func flagOrEnvDefault(value, env, def string) string {
+	if value = flagOrEnv(value, env); value == "" {
+		return def
+	}
+	return value
+}
+
+// Parses a duration flag, falling back to the environment variable if the flag is empty,
+// and to the default if neither is set
+func parseDurationOrEnv(value, env, def string) (time.Duration, error) {
+	value = flagOrEnvDefault(value, env, def)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("Invalid duration for " + env + ": " + value)
+	}
+	return d, nil
+}
+
+// Indicates whether the flag was passed on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 var G *Global
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseDurationOrEnv(t *testing.T) {
+	const env = "PAAS_TEST_TIMEOUT"
+	defer os.Unsetenv(env)
+
+	tests := []struct {
+		name    string
+		flag    string
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"default", "", "", 10 * time.Second, false},
+		{"environment", "", "1m", time.Minute, false},
+		{"flag over environment", "5s", "1m", 5 * time.Second, false},
+		{"disabled", "", "0", 0, false},
+		{"invalid", "", "soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(env, tt.env)
+			got, err := parseDurationOrEnv(tt.flag, env, "10s")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDurationOrEnv error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDurationOrEnv = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagOrEnvDefault(t *testing.T) {
+	const env = "PAAS_TEST_ADDR"
+	defer os.Unsetenv(env)
+
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		want string
+	}{
+		{"default", "", "", ":3443"},
+		{"environment", "", ":8443", ":8443"},
+		{"flag over environment", ":9443", ":8443", ":9443"},
+		{"flag", ":9443", "", ":9443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(env, tt.env)
+			if got := flagOrEnvDefault(tt.flag, env, ":3443"); got != tt.want {
+				t.Errorf("flagOrEnvDefault = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package internal
+
+// go_ingress.go
+// GoIngress serves each app on a dedicated port from inside the server process, like NginxPorts
+// but without an nginx container. Each app gets its own listener, which passes requests
+// straight to the app's reverse proxy at the root of the port. The listener looks the app up
+// for every request, so a redeployed app is picked up without restarting its listener, and
+// Reload has nothing to do. Removing an app closes its listener at once, while the requests in
+// flight on it are drained afterwards, so other apps can change meanwhile
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type GoIngress struct {
+	Host     string      // Host used in the external URLs of apps
+	BindHost string      // Host the listeners bind to, the host of -addr
+	TLS      *tls.Config // Serves the listeners over TLS when set
+
+	ports     *portAllocator
+	mu        sync.Mutex
+	listeners map[string]*appListener
+}
+
+type appListener struct {
+	server *http.Server
+	ln     *closeOnceListener
+	url    string
+}
+
+// closeOnceListener can be closed before the server is shut down, which closes it again
+type closeOnceListener struct {
+	net.Listener
+	once   sync.Once
+	closed int32
+	err    error
+}
+
+func (l *closeOnceListener) Close() error {
+	l.once.Do(func() {
+		atomic.StoreInt32(&l.closed, 1)
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
+
+func (l *closeOnceListener) isClosed() bool {
+	return atomic.LoadInt32(&l.closed) == 1
+}
+
+func NewGoIngress(host, bindHost string, tlsConfig *tls.Config, minPort, maxPort int) *GoIngress {
+	return &GoIngress{
+		Host:      host,
+		BindHost:  bindHost,
+		TLS:       tlsConfig,
+		ports:     newPortAllocator(minPort, maxPort),
+		listeners: make(map[string]*appListener),
+	}
+}
+
+// appPortHandler serves a single app at the root of its listener
+type appPortHandler struct {
+	id string
+}
+
+func (h appPortHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app, ok := G.AppMgr.Get(h.id)
+	if !ok {
+		appErrorResponse(w, r, "App not found", 404)
+		return
+	}
+
+	serveApp(w, r, app, "")
+}
+
+// Opens a listener for the app, unless it already has one, and returns its URL
+func (g *GoIngress) Write(app *App) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if l, ok := g.listeners[app.ID]; ok {
+		return l.url, nil
+	}
+
+	port, ok := g.ports.reserve(app.ID)
+	if !ok {
+		return "", errors.New("Out of ingress space")
+	}
+
+	// Listen before returning, so the app is reachable as soon as it is created
+	ln, err := net.Listen("tcp", net.JoinHostPort(g.BindHost, strconv.Itoa(port)))
+	if err != nil {
+		g.ports.release(app.ID)
+		return "", err
+	}
+
+	server := &http.Server{
+		Handler:           G.Logger.LogRequests(appPortHandler{app.ID}),
+		ReadTimeout:       G.ReadTimeout,
+		ReadHeaderTimeout: G.ReadHeaderTimeout,
+		WriteTimeout:      G.WriteTimeout,
+		IdleTimeout:       G.IdleTimeout,
+	}
+	h2 := &http2.Server{IdleTimeout: G.IdleTimeout}
+	scheme := "http"
+	if g.TLS != nil {
+		// Same certificates as the TLS address, with HTTP/2 negotiated by ALPN
+		server.TLSConfig = g.TLS.Clone()
+		if err = http2.ConfigureServer(server, h2); err != nil {
+			ln.Close()
+			g.ports.release(app.ID)
+			return "", err
+		}
+		ln = tls.NewListener(ln, server.TLSConfig)
+		scheme = "https"
+	} else {
+		// h2c lets gRPC clients reach apps on their own port, without a path prefix
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+	}
+	l := &appListener{
+		server: server,
+		ln:     &closeOnceListener{Listener: ln},
+		url:    scheme + "://" + net.JoinHostPort(g.Host, strconv.Itoa(port)),
+	}
+	go func() {
+		if err := server.Serve(l.ln); err != http.ErrServerClosed && !l.ln.isClosed() {
+			G.Logger.LogError(err)
+		}
+	}()
+
+	g.listeners[app.ID] = l
+	return l.url, nil
+}
+
+// Closes the app's listener, letting requests in flight finish until the drain timeout, and
+// frees its port
+func (g *GoIngress) Remove(app *App) error {
+	ctx, cancel := context.WithTimeout(context.Background(), G.DrainTimeout)
+	defer cancel()
+	return g.closeApp(app)(ctx)
+}
+
+// Closes the app's listener, so it accepts no more connections, and returns a function which
+// waits until the requests in flight finish or the context expires, then frees the port
+func (g *GoIngress) closeApp(app *App) func(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	l, ok := g.listeners[app.ID]
+	if !ok {
+		return func(context.Context) error { return nil }
+	}
+	delete(g.listeners, app.ID)
+	_ = l.ln.Close()
+
+	return func(ctx context.Context) error {
+		err := l.server.Shutdown(ctx)
+		if err != nil {
+			l.server.Close()
+		}
+
+		// The app may have been written again while draining, and its new listener owns the port
+		g.mu.Lock()
+		if _, ok := g.listeners[app.ID]; !ok {
+			g.ports.release(app.ID)
+		}
+		g.mu.Unlock()
+		return err
+	}
+}
+
+// Listeners are opened and closed by Write and Remove, so there is nothing to reload
+func (*GoIngress) Reload() error { return nil }
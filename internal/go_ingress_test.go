@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingRunner holds each request until release is closed
+type blockingRunner struct {
+	fakeRunner
+	release chan struct{}
+}
+
+func (b *blockingRunner) Invoke(w http.ResponseWriter, r *http.Request) {
+	b.requests <- r
+	<-b.release
+	w.WriteHeader(204)
+}
+
+// Returns a port nothing listens on
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestGoIngress(t *testing.T) {
+	// Supplies a certificate for 127.0.0.1 and a client trusting it
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+
+	tests := []struct {
+		name   string
+		tls    *tls.Config
+		scheme string
+		client *http.Client
+	}{
+		{"plain", nil, "http://", &http.Client{}},
+		{"tls", &tls.Config{Certificates: certServer.TLS.Certificates}, "https://", certServer.Client()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &blockingRunner{fakeRunner{requests: make(chan *http.Request, 1)}, make(chan struct{})}
+			app := &App{ID: "app", Runner: runner}
+			g := testGlobal(t, app)
+			g.DrainTimeout = 5 * time.Second
+
+			port := freePort(t)
+			ingress := NewGoIngress("127.0.0.1", "127.0.0.1", tt.tls, port, port)
+			url, err := ingress.Write(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(url, tt.scheme) {
+				t.Fatalf("url = %q, want scheme %q", url, tt.scheme)
+			}
+
+			status := make(chan int, 1)
+			go func() {
+				resp, err := tt.client.Get(url + "/path")
+				if err != nil {
+					t.Error(err)
+					status <- 0
+					return
+				}
+				resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+			if r := <-runner.requests; r.URL.Path != "/path" {
+				t.Errorf("app got path %q, want /path", r.URL.Path)
+			}
+
+			// Remove waits for the request in flight before freeing the port
+			removed := make(chan error, 1)
+			go func() { removed <- ingress.Remove(app) }()
+			select {
+			case err := <-removed:
+				t.Fatalf("Remove returned %v before the request finished", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(runner.release)
+			if got := <-status; got != 204 {
+				t.Errorf("status = %d, want 204", got)
+			}
+			if err := <-removed; err != nil {
+				t.Fatal(err)
+			}
+			next := &App{ID: "next", Runner: runner}
+			if _, err := ingress.Write(next); err != nil {
+				t.Fatalf("port not reusable after Remove: %v", err)
+			}
+			if err := ingress.Remove(next); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGoIngressDrainsWithoutLock(t *testing.T) {
+	runner := &blockingRunner{fakeRunner{requests: make(chan *http.Request, 1)}, make(chan struct{})}
+	app := &App{ID: "app", Runner: runner}
+	other := &App{ID: "other", Runner: runner}
+	g := testGlobal(t, app, other)
+	g.DrainTimeout = time.Hour
+
+	minPort := freePort(t)
+	ingress := NewGoIngress("127.0.0.1", "127.0.0.1", nil, minPort, minPort+1)
+	g.Ingress = ingress
+	url, err := initAppIngress(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-runner.requests
+
+	removed := make(chan error, 1)
+	go func() { removed <- removeAppIngress(app) }()
+
+	// The listener closes at once, while the request in flight is drained
+	addr := strings.TrimPrefix(url, "http://")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepting after Remove")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Other apps can change during the drain
+	written := make(chan error, 1)
+	go func() {
+		_, err := initAppIngress(other)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ingress change blocked by the drain")
+	}
+	select {
+	case err := <-removed:
+		t.Fatalf("Remove returned %v before the request finished", err)
+	default:
+	}
+
+	// Draining stops at the caller's deadline rather than the drain timeout
+	ingressMu.Lock()
+	drain := ingress.closeApp(other)
+	ingressMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := drain(ctx); err != nil {
+		t.Errorf("drain of an idle listener = %v", err)
+	}
+
+	ingressMu.Lock()
+	url, err = ingress.Write(other)
+	ingressMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request which is still being sent keeps the connection active
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	drain = ingress.closeApp(other)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("drain with a request in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drain took %v, past the caller's deadline", elapsed)
+	}
+
+	close(runner.release)
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+}
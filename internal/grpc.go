@@ -0,0 +1,71 @@
+package internal
+
+// grpc.go
+// gRPC requests are proxied to apps like any other HTTP/2 request, but errors
+// produced by the server itself must be reported using gRPC's status trailers.
+// gRPC clients treat any HTTP status other than 200 as a transport failure
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the server. See https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// Maps an HTTP status to the closest gRPC status code
+func grpcCode(status int) int {
+	switch status {
+	case 401:
+		return grpcUnauthenticated
+	case 403:
+		return grpcPermissionDenied
+	case 404:
+		return grpcNotFound
+	case 413, 429:
+		return grpcResourceExhausted
+	case 502, 503:
+		return grpcUnavailable
+	case 504:
+		return grpcDeadlineExceeded
+	default:
+		return grpcInternal
+	}
+}
+
+// Writes a trailers-only gRPC response with the given status
+func GRPCErrorResponse(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcCode(status)))
+	w.Header().Set("Grpc-Message", grpcEncodeMessage(message))
+	w.WriteHeader(200)
+}
+
+// grpc-message is percent-encoded, leaving printable ASCII other than '%' as-is
+func grpcEncodeMessage(message string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		}
+	}
+	return b.String()
+}
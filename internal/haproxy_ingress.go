@@ -0,0 +1,170 @@
+package internal
+
+// haproxy_ingress.go
+// HAProxyIngress writes a backend for each app into a directory loaded by HAProxy, and a map
+// from each host to its app's backend. A frontend selects the backend with the map, such as
+//   use_backend %[req.hdr(host),lower,word(1,:),map(/etc/haproxy/paas.map)]
+// Apps are served at <id>.<domain> and their custom domains, and each backend forwards to this
+// server. HAProxy only reads new backends when it is reloaded, which is done by running the
+// reload command after a change
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type HAProxyIngress struct {
+	Dir           string // Directory HAProxy loads the backends from
+	MapFile       string // Map of hosts to backends
+	Domain        string // Apps are served at <id>.<Domain>
+	Upstream      string // Address HAProxy reaches this server at
+	ReloadCommand string // Shell command reloading HAProxy. Empty means HAProxy is reloaded by something else
+
+	tmpl    *ingressTemplate
+	mu      sync.Mutex
+	hosts   map[string][]string // Hosts of each app
+	changed bool
+}
+
+const haproxyTemplate = `backend {{ .Name }}
+	option forwardfor
+	http-request set-header X-Forwarded-Proto https if { ssl_fc }
+	http-request set-header X-Forwarded-Proto http if !{ ssl_fc }
+	http-request set-header X-Forwarded-Host %[req.hdr(host)]
+	http-request set-header X-Forwarded-Prefix /
+	server app {{ .Addr }}{{ if .HTTP2 }} proto h2{{ end }}
+`
+
+// Creates the ingress, keeping the hosts of the apps whose backends were left by a previous run
+func NewHAProxyIngress(dir, mapFile, domain, upstream, reloadCommand, templateFile string) (*HAProxyIngress, error) {
+	if dir == "" || mapFile == "" {
+		return nil, errors.New("The HAProxy ingress requires a directory and a map file to write configuration to")
+	}
+	tmpl, err := newIngressTemplate("haproxy", haproxyTemplate, templateFile)
+	if err != nil {
+		return nil, err
+	}
+	h := &HAProxyIngress{
+		Dir:           dir,
+		MapFile:       mapFile,
+		Domain:        domain,
+		Upstream:      upstream,
+		ReloadCommand: reloadCommand,
+		tmpl:          tmpl,
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *HAProxyIngress) file(id string) string {
+	return path.Join(h.Dir, id+".cfg")
+}
+
+// Reads the hosts from the map file, dropping the ones whose backend no longer exists
+func (h *HAProxyIngress) load() error {
+	h.hosts = make(map[string][]string)
+
+	b, err := ioutil.ReadFile(h.MapFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "paas-") {
+			continue
+		}
+		id := strings.TrimPrefix(fields[1], "paas-")
+		if !appIDPattern.MatchString(id) {
+			continue
+		}
+		if _, err := os.Stat(h.file(id)); err != nil {
+			continue
+		}
+		h.hosts[id] = append(h.hosts[id], fields[0])
+	}
+	return scanner.Err()
+}
+
+// Rewrites the map file from the hosts of every app. Must be called with the lock held
+func (h *HAProxyIngress) writeMap() error {
+	var lines []string
+	for id, hosts := range h.hosts {
+		for _, host := range hosts {
+			lines = append(lines, host+" paas-"+id+"\n")
+		}
+	}
+	sort.Strings(lines)
+	return writeFileAtomic(h.MapFile, []byte(strings.Join(lines, "")), 0664)
+}
+
+// Writes the app's backend and adds its hosts to the map, returning the URL of its first host
+func (h *HAProxyIngress) Write(app *App) (string, error) {
+	hosts := appHosts(app, h.Domain)
+	if len(hosts) == 0 {
+		return "", errors.New("The app needs a domain to be served by HAProxy")
+	}
+
+	b, err := h.tmpl.execute(newIngressTemplateData(app, hosts, h.Upstream))
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// HAProxy only loads .cfg files, so it never reads the temp file
+	if err := writeFileAtomic(h.file(app.ID), b, 0664); err != nil {
+		return "", err
+	}
+	h.hosts[app.ID] = hosts
+	h.changed = true
+	if err := h.writeMap(); err != nil {
+		return "", err
+	}
+	return "http://" + hosts[0], nil
+}
+
+// Deletes the app's backend and removes its hosts from the map
+func (h *HAProxyIngress) Remove(app *App) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.Remove(h.file(app.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, ok := h.hosts[app.ID]; !ok {
+		return nil
+	}
+	delete(h.hosts, app.ID)
+	h.changed = true
+	return h.writeMap()
+}
+
+// Runs the reload command if anything changed since the last reload
+func (h *HAProxyIngress) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.changed || h.ReloadCommand == "" {
+		return nil
+	}
+	if out, err := exec.Command("sh", "-c", h.ReloadCommand).CombinedOutput(); err != nil {
+		return errors.New("Could not reload HAProxy: " + commandOutput(out, err))
+	}
+	h.changed = false
+	return nil
+}
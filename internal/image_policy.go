@@ -0,0 +1,263 @@
+package internal
+
+// image_policy.go
+// Policy for the images apps may be created from. The policy is a json file like:
+//
+//   {
+//       "allowedImages": ["node-14", "registry.example.test/apps/*"],
+//       "forbiddenImages": ["docker:*"],
+//       "requiredLabels": {"com.example.team": ""},
+//       "forbiddenLabels": ["com.example.privileged"],
+//       "requireDigest": true
+//   }
+//
+// Images and patterns are normalized the way docker resolves image names, so nginx,
+// docker.io/library/nginx and index.docker.io/library/nginx all name the same repository.
+// Patterns use path.Match syntax for the repository and any tag or digest. A pattern without
+// a tag or digest matches every reference to the repository, and a tag pattern of * also
+// matches references by digest. A required label with an empty value only needs to be present. The file is re-read when it changes. The policy fails
+// closed: if the file can't be loaded or the image can't be inspected, the image is rejected
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/docker/distribution/reference"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+type ImagePolicyRules struct {
+	AllowedImages   []string          `json:"allowedImages"`   // If not empty, images must match one of these patterns
+	ForbiddenImages []string          `json:"forbiddenImages"` // Images matching these patterns are rejected, such as privileged images
+	RequiredLabels  map[string]string `json:"requiredLabels"`  // Labels the image must have
+	ForbiddenLabels []string          `json:"forbiddenLabels"` // Labels the image must not have
+	RequireDigest   bool              `json:"requireDigest"`   // Images must be referenced by digest, like name@sha256:...
+}
+
+// PolicyViolation describes a single rule which an image breaks
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ImagePolicy holds the rules loaded from the policy file
+type ImagePolicy struct {
+	file  *watchedFile
+	mu    sync.Mutex
+	rules *ImagePolicyRules
+}
+
+// Loads the policy file. Without a file every image is allowed
+func NewImagePolicy(file string) (*ImagePolicy, error) {
+	p := &ImagePolicy{
+		file:  &watchedFile{path: file},
+		rules: &ImagePolicyRules{},
+	}
+	if _, err := p.current(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Returns the rules, re-reading the file if it changed. If the file can't be read or
+// parsed the previous rules are kept and the error is returned
+func (p *ImagePolicy) current() (*ImagePolicyRules, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok, err := p.file.changed()
+	if err != nil {
+		return p.rules, err
+	}
+	if ok {
+		rules := &ImagePolicyRules{}
+		if err := json.Unmarshal(b, rules); err != nil {
+			return p.rules, err
+		}
+		p.rules = rules
+	}
+	return p.rules, nil
+}
+
+// An image reference normalized the way docker resolves it
+type imageRef struct {
+	name   string // Repository including its registry, like docker.io/library/nginx
+	tag    string // Tag, latest when the reference has neither a tag nor a digest
+	digest string // Digest, like sha256:<hex>, when the image is pinned to one
+}
+
+// Parses and normalizes an image reference. Digests are checked to have the right format
+// and length for their algorithm
+func parseImageRef(image string) (*imageRef, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := &imageRef{name: named.Name()}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.tag = tagged.Tag()
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		if err := canonical.Digest().Validate(); err != nil {
+			return nil, err
+		}
+		ref.digest = canonical.Digest().String()
+	} else if ref.tag == "" {
+		ref.tag = "latest"
+	}
+	return ref, nil
+}
+
+// Splits an image pattern into its repository, tag, and digest patterns, adding the registry
+// and library/ prefix docker would add to the repository
+func splitImagePattern(pattern string) (name, tag, digest string) {
+	name = pattern
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+	}
+	// A colon after the last slash separates the tag, one before it is a registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+
+	domain, remainder := "docker.io", name
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		domain, remainder = name[:i], name[i+1:]
+	}
+	if domain == "index.docker.io" {
+		domain = "docker.io"
+	}
+	if domain == "docker.io" && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	return domain + "/" + remainder, tag, digest
+}
+
+func matchImage(patterns []string, ref *imageRef) bool {
+	for _, pattern := range patterns {
+		name, tag, digest := splitImagePattern(pattern)
+		if ok, _ := path.Match(name, ref.name); !ok {
+			continue
+		}
+
+		var ok bool
+		switch {
+		case digest != "":
+			ok, _ = path.Match(digest, ref.digest)
+			ok = ok && ref.digest != ""
+		case tag == "":
+			ok = true
+		case ref.tag != "":
+			ok, _ = path.Match(tag, ref.tag)
+		default:
+			// The tags of an image referenced by digest are unknown, only a pattern matching any tag applies
+			ok = tag == "*"
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns every rule the image breaks. Labels are read from the image on the docker host.
+// An error means the image couldn't be checked, and must be rejected
+func (p *ImagePolicy) Check(ctx context.Context, image string) ([]PolicyViolation, error) {
+	rules, err := p.current()
+	if err != nil {
+		return nil, errors.New("Could not load the image policy: " + err.Error())
+	}
+
+	violations := make([]PolicyViolation, 0)
+
+	if image == "" {
+		return append(violations, PolicyViolation{"image", "An image is required"}), nil
+	}
+
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return append(violations, PolicyViolation{"image", "Invalid image reference " + image + ": " + err.Error()}), nil
+	}
+
+	if rules.RequireDigest && ref.digest == "" {
+		violations = append(violations, PolicyViolation{"requireDigest", "Image must be pinned to a digest, like " + ref.name + "@sha256:<digest>"})
+	}
+
+	if len(rules.AllowedImages) > 0 && !matchImage(rules.AllowedImages, ref) {
+		violations = append(violations, PolicyViolation{"allowedImages", "Image " + image + " is not in the list of allowed images"})
+	}
+
+	if matchImage(rules.ForbiddenImages, ref) {
+		violations = append(violations, PolicyViolation{"forbiddenImages", "Image " + image + " is forbidden"})
+	}
+
+	if len(rules.RequiredLabels) == 0 && len(rules.ForbiddenLabels) == 0 {
+		return violations, nil
+	}
+
+	inspect, _, err := G.Docker.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, errors.New("Could not read the labels of image " + image + ": " + err.Error())
+	}
+
+	var labels map[string]string
+	if inspect.Config != nil {
+		labels = inspect.Config.Labels
+	}
+
+	for label, value := range rules.RequiredLabels {
+		actual, ok := labels[label]
+		if !ok || (value != "" && actual != value) {
+			violations = append(violations, PolicyViolation{"requiredLabels", "Image must have label " + label + labelValue(value)})
+		}
+	}
+
+	for _, label := range rules.ForbiddenLabels {
+		if _, ok := labels[label]; ok {
+			violations = append(violations, PolicyViolation{"forbiddenLabels", "Image must not have label " + label})
+		}
+	}
+
+	return violations, nil
+}
+
+// Names of the violated rules, separated by commas
+func violatedRules(violations []PolicyViolation) string {
+	rules := make([]string, len(violations))
+	for i, v := range violations {
+		rules[i] = v.Rule
+	}
+	return strings.Join(rules, ", ")
+}
+
+func labelValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "=" + value
+}
+
+type policyErrorResponse struct {
+	Error      bool              `json:"error"`
+	Message    string            `json:"message"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+// Responds with a 403 listing every violated rule. The message names the image and the
+// rules, so they are kept in the audit log along with the rejection
+func PolicyErrorResponse(w http.ResponseWriter, image string, violations []PolicyViolation) {
+	message := "Image " + image + " violates policy: " + violatedRules(violations)
+
+	b, err := json.Marshal(&policyErrorResponse{true, message, violations})
+	if err != nil {
+		ErrorResponse(w, message, 403)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(403)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImagePolicyCheck(t *testing.T) {
+	g := testGlobal(t)
+
+	// Stands in for the docker API with a few images on the host
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/registry.example.test/apps/web/json"),
+			strings.HasSuffix(r.URL.Path, "/images/docker.io/library/nginx/json"):
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"Id":"sha256:1","Config":{"Labels":{"com.example.team":"web"}}}`))
+		case strings.HasSuffix(r.URL.Path, "/images/registry.example.test/apps/privileged/json"):
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"Id":"sha256:2","Config":{"Labels":{"com.example.team":"ops","com.example.privileged":"true"}}}`))
+		default:
+			http.Error(w, `{"message":"No such image"}`, 404)
+		}
+	}))
+	defer docker.Close()
+
+	var err error
+	g.Docker, err = client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(docker.URL, "http://")), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"allowedImages": ["registry.example.test/apps/*"],
+		"forbiddenImages": ["registry.example.test/apps/docker"],
+		"requiredLabels": {"com.example.team": ""},
+		"forbiddenLabels": ["com.example.privileged"]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewImagePolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		image   string
+		want    string // Violated rules
+		wantErr bool
+	}{
+		{"allowed", "registry.example.test/apps/web", "", false},
+		{"tag not on the host", "registry.example.test/apps/web:latest", "", true},
+		{"no image", "", "image", false},
+		{"not allowed", "docker.io/library/nginx", "allowedImages", false},
+		{"forbidden and not on the host", "registry.example.test/apps/docker", "", true},
+		{"forbidden label", "registry.example.test/apps/privileged", "forbiddenLabels", false},
+		// Images which can't be inspected are rejected rather than let through without their labels checked
+		{"unknown image", "registry.example.test/apps/missing", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := policy.Check(context.Background(), tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := violatedRules(violations); got != tt.want {
+				t.Errorf("Check violated %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A policy file which no longer parses rejects every image
+	if err := ioutil.WriteFile(file, []byte(`{"allowedImages": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := policy.Check(context.Background(), "registry.example.test/apps/web"); err == nil {
+		t.Error("Check succeeded with an invalid policy file")
+	}
+}
+
+func TestImagePolicyReferences(t *testing.T) {
+	testGlobal(t)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name      string
+		forbidden string
+		image     string
+		want      string // Violated rules
+	}{
+		{"familiar name", "docker.io/library/docker:*", "docker", "forbiddenImages"},
+		{"familiar tag", "docker.io/library/docker:*", "docker:24-dind", "forbiddenImages"},
+		{"digest", "docker.io/library/docker:*", "docker@" + digest, "forbiddenImages"},
+		{"legacy registry", "docker.io/library/docker:*", "index.docker.io/library/docker", "forbiddenImages"},
+		{"familiar pattern", "docker:*", "docker.io/library/docker:24", "forbiddenImages"},
+		{"familiar pattern with legacy registry", "docker", "index.docker.io/library/docker@" + digest, "forbiddenImages"},
+		{"other tag", "docker:24-*", "docker:25", ""},
+		{"digest with a specific tag pattern", "docker:24", "docker@" + digest, ""},
+		{"pinned digest", "docker@" + digest, "docker:24@" + digest, "forbiddenImages"},
+		{"user repository", "*/*", "someone/tool", "forbiddenImages"},
+		{"official images are in the library namespace", "*/*", "nginx", "forbiddenImages"},
+		{"other registry", "docker", "registry.example.test/docker", ""},
+		{"registry with port", "registry.example.test:5000/*", "registry.example.test:5000/tool:1", "forbiddenImages"},
+		{"short digest", "nginx", "other@sha256:abc", "image"},
+		{"uppercase", "nginx", "Docker", "image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &ImagePolicy{file: &watchedFile{}, rules: &ImagePolicyRules{ForbiddenImages: []string{tt.forbidden}}}
+			violations, err := policy.Check(context.Background(), tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := violatedRules(violations); got != tt.want {
+				t.Errorf("Check violated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImagePolicyRequireDigest(t *testing.T) {
+	testGlobal(t)
+	policy := &ImagePolicy{file: &watchedFile{}, rules: &ImagePolicyRules{RequireDigest: true}}
+
+	tests := []struct {
+		image string
+		want  string // Violated rules
+	}{
+		{"nginx@sha256:" + strings.Repeat("0", 64), ""},
+		{"nginx:1.25@sha256:" + strings.Repeat("0", 64), ""},
+		{"nginx:1.25", "requireDigest"},
+		{"nginx:latest-@sha256:", "image"},
+		{"nginx@sha256:" + strings.Repeat("z", 64), "image"},
+		{"nginx@sha256:" + strings.Repeat("0", 63), "image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			violations, err := policy.Check(context.Background(), tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := violatedRules(violations); got != tt.want {
+				t.Errorf("Check violated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
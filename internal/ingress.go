@@ -7,23 +7,45 @@ package internal
 // endpoint only. Adding an ingress service will allow a reverse proxy for
 // the apps, which could enable each app to have a unique subdomain or port number
 import (
+	"context"
 	"errors"
-	"math/rand"
-	"net/url"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
-	"text/template"
 )
 
+// IngressServer configures the proxy apps are reached through. Ingresses which serve apps by
+// host, such as caddy, traefik, and haproxy, forward requests to this server with the Host
+// header intact, so the server routes each request to its app by its host
 type IngressServer interface {
 	Write(*App) (string, error) // Writes the settings from the app runner into the global ingress configuration
 	Remove(*App) error          // Remove the settings saved for this app
 	Reload() error              // Activates the new ingress settings
 }
 
+// Implemented by ingresses which apply an app's change together with the changes of concurrent
+// requests, and report the outcome of that app's change alone. ingressMu isn't held while they do
+type appReloader interface {
+	reloadApp(app *App) error
+}
+
+// Implemented by ingresses which serve requests themselves. Closing an app stops new
+// connections with ingressMu held, and the returned function drains the requests in flight
+// once it is released
+type appCloser interface {
+	closeApp(app *App) func(ctx context.Context) error
+}
+
+// Implemented by ingresses which can't serve every app ID, so those IDs are rejected before
+// the app is created
+type appIDChecker interface {
+	checkAppID(id string) error
+}
+
 // NoIngress: there is no reverse proxy or ingress service in front of this application server
 type NoIngress struct{}
 
@@ -32,12 +54,15 @@ func (NoIngress) Remove(*App) error            { return nil }
 func (NoIngress) Reload() error                { return nil }
 
 // NginxPorts represents an Nginx reverse proxy that uses a different port for each app
-// The size of the number of ports could be configurable, but since a script would need to be set up
-// to create the Nginx container using the same port range, it is easiest for tests to keep it at 100
+// The ports come from a configurable range, which must match the ports published by the Nginx container.
+// An app keeps its port when it is redeployed, and the ports in the conf files already in NginxAppDir are
+// reserved for their apps at startup, so apps keep their ports across restarts as well
 type NginxPorts struct {
 	NginxAppDir string
+	conf        *nginxConfig
 	confMu      *sync.Mutex
-	ports       [100]bool
+	tmpl        *ingressTemplate
+	ports       *portAllocator
 	apps        map[string]confPortEntry
 }
 
@@ -46,40 +71,106 @@ type confPortEntry struct {
 	file string
 }
 
-// Write a new nginx conf file for the app using the app runner specified
-func (n *NginxPorts) Write(app *App) (string, error) {
-	const nginxTemplate = "server {\n\tlisten {{ .Port }};\n  \n\tlocation / {\n\t\tproxy_pass {{ .Url }}/;\n\t}\n}"
+var nginxListenPattern = regexp.MustCompile(`listen\s+(\d+)`)
 
-	file := path.Join(n.NginxAppDir, app.ID+".conf")
-
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0664)
+// Creates the ingress for a range of ports, reserving the ports of the conf files in appDir.
+// The template file replaces the built-in server block when one is given
+func NewNginxPorts(appDir string, minPort, maxPort int, templateFile string) (*NginxPorts, error) {
+	tmpl, err := newIngressTemplate("nginx", nginxTemplate, templateFile)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	n := &NginxPorts{
+		NginxAppDir: appDir,
+		conf:        newNginxConfig(appDir),
+		confMu:      &sync.Mutex{},
+		tmpl:        tmpl,
+		ports:       newPortAllocator(minPort, maxPort),
 	}
-	defer f.Close()
 
-	frontend, err := url.Parse("http://" + G.Addr + "/app/" + app.ID)
+	n.confMu.Lock()
+	defer n.confMu.Unlock()
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Rebuilds the apps and their ports from the conf files. Must be called with the lock held
+func (n *NginxPorts) load() error {
+	n.apps = make(map[string]confPortEntry)
+	n.ports.reset()
+
+	files, err := ioutil.ReadDir(n.NginxAppDir)
 	if err != nil {
-		return "", err
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range files {
+		id := strings.TrimSuffix(info.Name(), ".conf")
+		if info.IsDir() || id == info.Name() || !appIDPattern.MatchString(id) {
+			continue
+		}
+		if err := n.loadApp(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuilds the app and its port from its conf file, dropping them if there is no file.
+// Must be called with the lock held
+func (n *NginxPorts) loadApp(id string) error {
+	file := n.conf.file(id)
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	match := nginxListenPattern.FindSubmatch(b)
+	if match == nil {
+		n.ports.release(id)
+		delete(n.apps, id)
+		return nil
+	}
+	// Files using a port outside the range, such as from before the range was changed, are left alone
+	port, _ := strconv.Atoi(string(match[1]))
+	if !n.ports.claim(id, port) {
+		n.ports.release(id)
+		delete(n.apps, id)
+		return nil
 	}
+	n.apps[id] = confPortEntry{port, file}
+	return nil
+}
 
-	port, ok := n.reservePort()
+// Write a new nginx conf file for the app using the app runner specified
+func (n *NginxPorts) Write(app *App) (string, error) {
+	n.confMu.Lock()
+	defer n.confMu.Unlock()
+
+	port, ok := n.ports.reserve(app.ID)
 	if !ok {
 		return "", errors.New("Out of ingress space")
 	}
 
-	t := template.Must(template.New("conf").Parse(nginxTemplate))
-	err = t.Execute(f, struct {
-		Port int
-		Url  string
-	}{port, frontend.String()})
+	// The app is served at the root of its port, which nginx reports to the server as the forwarded prefix
+	file := n.conf.file(app.ID)
+	b, err := renderNginx(n.tmpl, app, port, nil)
+	if err == nil {
+		err = n.conf.write(file, b)
+	}
 	if err != nil {
+		// A redeployed app keeps the port its current conf file uses
+		if _, existing := n.apps[app.ID]; !existing {
+			n.ports.release(app.ID)
+		}
 		return "", err
 	}
-
-	n.confMu.Lock()
 	n.apps[app.ID] = confPortEntry{port, file}
-	n.confMu.Unlock()
 
 	return ":" + strconv.Itoa(port), nil
 }
@@ -90,44 +181,42 @@ func (n *NginxPorts) Remove(app *App) error {
 	defer n.confMu.Unlock()
 
 	if entry, ok := n.apps[app.ID]; ok {
-		if err := os.Remove(entry.file); err != nil {
+		if err := n.conf.remove(entry.file); err != nil {
 			return err
 		}
-		n.ports[entry.port-5000] = false
+		n.ports.release(app.ID)
 		delete(n.apps, app.ID)
 	}
 	return nil
 }
 
-// Reload the current nginx instance by exec'ing a new process
-func (*NginxPorts) Reload() error {
-	cmd := exec.Command("nginx", "-s", "reload")
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-	err = cmd.Wait()
-	if err != nil {
-		return err
-	}
-	return nil
+// Reload the current nginx instance, applying every staged change at once. Apps whose
+// changes were rejected are rebuilt from their conf files
+func (n *NginxPorts) Reload() error {
+	rejected, err := n.conf.apply("")
+	n.restore(rejected)
+	return err
 }
 
-func (n *NginxPorts) reservePort() (int, bool) {
-	if len(n.apps) == 100 {
-		return 0, false
-	}
+// Applies the app's change together with any concurrent changes, and reports whether the
+// app's change was applied
+func (n *NginxPorts) reloadApp(app *App) error {
+	rejected, err := n.conf.apply(n.conf.file(app.ID))
+	n.restore(rejected)
+	return err
+}
 
+// Rebuilds the apps whose changes were rejected from their live conf files
+func (n *NginxPorts) restore(files []string) {
+	if len(files) == 0 {
+		return
+	}
 	n.confMu.Lock()
-	port := rand.Intn(100)
+	defer n.confMu.Unlock()
 
-	// If the current port is in use, search for an open port linearly
-	for n.ports[port] {
-		port = port + 1%100
+	for _, file := range files {
+		if err := n.loadApp(strings.TrimSuffix(path.Base(file), ".conf")); err != nil {
+			G.Logger.LogError(err)
+		}
 	}
-
-	n.ports[port] = true
-	n.confMu.Unlock()
-
-	return port + 5000, true
 }
@@ -0,0 +1,159 @@
+package internal
+
+// ingress_template.go
+// Templates used by the ingresses which render configuration files. Each ingress has a built-in
+// template, which can be replaced by a template file so the configuration can be customized
+// without recompiling. The file is re-read when it changes, and an invalid file is reported
+// without replacing the last template which parsed
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type ingressTemplate struct {
+	name string
+	file *watchedFile
+
+	mu   sync.Mutex
+	tmpl *template.Template
+}
+
+// Data available to ingress templates
+type ingressTemplateData struct {
+	App      *App
+	ID       string
+	Name     string   // Name of the app's router or backend in the ingress configuration
+	Hosts    []string // <id>.<domain> and the app's custom domains
+	Prefix   string   // Path prefix the server serves the app under
+	Addr     string   // Address the ingress reaches this server at
+	Upstream string   // URL of the app on this server
+	HTTP2    bool     // Whether the app must be reached over HTTP/2
+}
+
+var ingressTemplateFuncs = template.FuncMap{
+	"quote":   strconv.Quote,
+	"join":    strings.Join,
+	"seconds": templateSeconds,
+}
+
+// Whole seconds in a duration, rounded up so timeouts are never shortened
+func templateSeconds(d Duration) int64 {
+	return int64((time.Duration(d) + time.Second - 1) / time.Second)
+}
+
+// Parses the built-in template, and the template file replacing it when one is given
+func newIngressTemplate(name, builtin, file string) (*ingressTemplate, error) {
+	t := &ingressTemplate{
+		name: name,
+		file: &watchedFile{path: file},
+	}
+	tmpl, err := t.parse(builtin)
+	if err != nil {
+		return nil, err
+	}
+	t.tmpl = tmpl
+	if _, err := t.current(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *ingressTemplate) parse(text string) (*template.Template, error) {
+	return template.New(t.name).Funcs(ingressTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// Returns the template, re-parsing the file if it changed. If the file can't be read or
+// parsed the previous template is kept and the error is returned
+func (t *ingressTemplate) current() (*template.Template, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok, err := t.file.changed()
+	if err != nil {
+		return t.tmpl, err
+	}
+	if ok {
+		tmpl, err := t.parse(string(b))
+		if err != nil {
+			return t.tmpl, err
+		}
+		t.tmpl = tmpl
+	}
+	return t.tmpl, nil
+}
+
+// Renders the template for an app
+func (t *ingressTemplate) execute(data interface{}) ([]byte, error) {
+	tmpl, err := t.current()
+	if err != nil {
+		G.Logger.Warning("Using the previous ingress template: " + err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fills in the template data for an app, which the ingress reaches at the upstream address
+func newIngressTemplateData(app *App, hosts []string, upstream string) ingressTemplateData {
+	return ingressTemplateData{
+		App:      app,
+		ID:       app.ID,
+		Name:     "paas-" + app.ID,
+		Hosts:    hosts,
+		Prefix:   "/app/" + app.ID,
+		Addr:     upstream,
+		Upstream: "http://" + upstream,
+		HTTP2:    isHTTP2(app.Protocol),
+	}
+}
+
+var headerNamePattern = regexp.MustCompile("^[A-Za-z0-9-]+$")
+
+// Headers describing how the response is framed, which would corrupt it if replaced
+var framingHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Checks the headers requested for an app. Values are limited to printable characters which
+// no ingress interprets, so they end up in responses exactly as given, including from
+// custom ingress templates
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !headerNamePattern.MatchString(name) {
+			return errors.New("Invalid header name: " + name)
+		}
+		if framingHeaders[http.CanonicalHeaderKey(name)] {
+			return errors.New("Header can't be set for an app: " + name)
+		}
+		for _, c := range value {
+			if c < ' ' || c > '~' || c == '$' || c == '%' || c == '\\' {
+				return errors.New("Invalid value for header " + name + ": only printable ASCII without $, %, or \\ is allowed")
+			}
+		}
+	}
+	return nil
+}
+
+// Hosts an app is served at by the host-based ingresses
+func appHosts(app *App, domain string) []string {
+	var hosts []string
+	if domain != "" {
+		hosts = append(hosts, app.ID+"."+domain)
+	}
+	return append(hosts, app.Domains...)
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeRunner records the requests the server passes on to the app
+type fakeRunner struct {
+	requests chan *http.Request
+}
+
+func (*fakeRunner) Create() error    { return nil }
+func (*fakeRunner) Cleanup() error   { return nil }
+func (*fakeRunner) StopJobs()        {}
+func (*fakeRunner) IsReady() bool    { return true }
+func (*fakeRunner) BlockUntilReady() {}
+func (*fakeRunner) Addr() string     { return "app:8080" }
+func (f *fakeRunner) Invoke(w http.ResponseWriter, r *http.Request) {
+	f.requests <- r
+	w.WriteHeader(204)
+}
+
+// The server's routes which apps are reached through
+func testAppMux() *RegexMux {
+	mux := &RegexMux{NotFound: http.NotFoundHandler()}
+	mux.HandleHost(AppHostHandler{}, AppHostHandler{})
+	mux.Handle("/app/[a-zA-Z0-9_-]+", &AppHandler{})
+	return mux
+}
+
+var (
+	traefikPrefixPattern = regexp.MustCompile(`addPrefix:\s+prefix: "([^"]*)"`)
+	haproxyPathPattern   = regexp.MustCompile(`set-path (\S*)%\[path\]`)
+	haproxyHostPattern   = regexp.MustCompile(`set-header Host (\S+)`)
+	nginxPassPattern     = regexp.MustCompile(`proxy_pass (\S+);`)
+)
+
+// Builds the request an ingress sends to the server for a client request, following the
+// parts of its rendered configuration which change the host and path
+func ingressRequest(t *testing.T, ingress, config, host, path string) *http.Request {
+	switch ingress {
+	case "traefik":
+		if m := traefikPrefixPattern.FindStringSubmatch(config); m != nil {
+			path = m[1] + path
+		}
+		if strings.Contains(config, "passHostHeader: false") {
+			host = "localhost:3000"
+		}
+	case "haproxy":
+		if m := haproxyPathPattern.FindStringSubmatch(config); m != nil {
+			path = m[1] + path
+		}
+		if m := haproxyHostPattern.FindStringSubmatch(config); m != nil {
+			host = m[1]
+		}
+	case "nginx":
+		// With a URI in proxy_pass, the matched location "/" is replaced by it, and nginx sends
+		// the host of proxy_pass unless the Host header is set
+		m := nginxPassPattern.FindStringSubmatch(config)
+		if m == nil {
+			t.Fatalf("no proxy_pass in:\n%s", config)
+		}
+		u, err := url.Parse(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		path = u.Path + strings.TrimPrefix(path, "/")
+		if !strings.Contains(config, "proxy_set_header Host") {
+			host = u.Host
+		}
+	}
+	return httptest.NewRequest("GET", "http://"+host+path, nil)
+}
+
+// Renders each built-in template and sends the request the ingress would make through the
+// server's routes, checking the app sees the path the client asked for
+func TestIngressTemplatesReachAppRoot(t *testing.T) {
+	g := testGlobal(t)
+	g.Addr = "localhost:3000"
+	g.AppDomain = "apps.example.com"
+
+	render := map[string]func(t *testing.T, app *App) string{
+		"traefik": func(t *testing.T, app *App) string {
+			ingress, err := NewTraefikIngress(t.TempDir(), g.AppDomain, g.Addr, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return writeAndRead(t, ingress, app, ingress.file(app.ID))
+		},
+		"haproxy": func(t *testing.T, app *App) string {
+			dir := t.TempDir()
+			ingress, err := NewHAProxyIngress(dir, dir+"/paas.map", g.AppDomain, g.Addr, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return writeAndRead(t, ingress, app, ingress.file(app.ID))
+		},
+		"nginx": func(t *testing.T, app *App) string {
+			tmpl, err := newIngressTemplate("nginx", nginxTemplate, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := renderNginx(tmpl, app, 5000, []string{app.ID + "." + g.AppDomain})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(b)
+		},
+	}
+
+	tests := []struct {
+		ingress     string
+		stripPrefix bool
+		path        string
+	}{
+		{"traefik", true, "/"},
+		{"traefik", true, "/a/b?c=d"},
+		{"traefik", false, "/a/b"},
+		{"haproxy", true, "/"},
+		{"haproxy", true, "/a/b?c=d"},
+		{"haproxy", false, "/a/b"},
+		// nginx reaches apps through /app/<id> even in hosts mode, which only removes the prefix when stripPrefix is on
+		{"nginx", true, "/"},
+		{"nginx", true, "/a/b?c=d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ingress+tt.path, func(t *testing.T) {
+			runner := &fakeRunner{requests: make(chan *http.Request, 1)}
+			app := &App{ID: "app", StripPrefix: tt.stripPrefix, Runner: runner}
+			g.AppMgr.apps = map[string]*App{app.ID: app}
+
+			config := render[tt.ingress](t, app)
+			w := httptest.NewRecorder()
+			testAppMux().ServeHTTP(w, ingressRequest(t, tt.ingress, config, "app.apps.example.com", tt.path))
+			if w.Code != 204 {
+				t.Fatalf("server responded %d: %s\nconfig:\n%s", w.Code, w.Body.String(), config)
+			}
+
+			r := <-runner.requests
+			if got := r.URL.RequestURI(); got != tt.path {
+				t.Errorf("app got %s, want %s\nconfig:\n%s", got, tt.path, config)
+			}
+		})
+	}
+}
+
+func writeAndRead(t *testing.T, ingress IngressServer, app *App, file string) string {
+	if _, err := ingress.Write(app); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
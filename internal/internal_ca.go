@@ -0,0 +1,287 @@
+package internal
+
+// internal_ca.go
+// A private certificate authority used for mutual TLS between the server and app containers.
+// Apps with mtls enabled get a server certificate for their container name, which is copied
+// into the container along with the CA certificate when the container is created. The proxy
+// verifies the container's certificate against the CA and presents a client certificate
+// issued by the same CA, so apps can check that requests come from this server.
+// The CA is created the first time it is needed and stored in -internal-ca-cert and
+// -internal-ca-key. The client certificate is kept in memory and renewed before it expires
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	internalCALifetime = 10 * 365 * 24 * time.Hour
+	appCertLifetime    = 365 * 24 * time.Hour
+	clientCertLifetime = 30 * 24 * time.Hour
+
+	// Directory in app containers the certificate, key, and CA certificate are copied to
+	appCertDir = "/etc/paas/tls"
+)
+
+// InternalCA issues the certificates used between the server and app containers
+type InternalCA struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	pool    *x509.CertPool
+	client  *tls.Certificate
+}
+
+func NewInternalCA(certFile, keyFile string) *InternalCA {
+	return &InternalCA{certFile: certFile, keyFile: keyFile}
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Loads the CA from its files, creating it if neither exists. Must be called with the lock held
+func (ca *InternalCA) load() error {
+	if ca.cert != nil {
+		return nil
+	}
+	if ca.certFile == "" || ca.keyFile == "" {
+		return errors.New("The internal CA requires a certificate and key file")
+	}
+
+	certPEM, certErr := ioutil.ReadFile(ca.certFile)
+	keyPEM, keyErr := ioutil.ReadFile(ca.keyFile)
+	switch {
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		var err error
+		if certPEM, keyPEM, err = ca.create(); err != nil {
+			return err
+		}
+		G.Logger.Info("Created the internal CA in " + ca.certFile)
+	case certErr != nil:
+		return certErr
+	case keyErr != nil:
+		return keyErr
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("The internal CA key must be an ECDSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !cert.IsCA {
+		return errors.New("The internal CA certificate is not a CA certificate")
+	}
+
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = certPEM
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(cert)
+	return nil
+}
+
+// Generates a new CA and writes it to the CA files
+func (ca *InternalCA) create() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "container-paas internal CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(internalCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ioutil.WriteFile(ca.keyFile, keyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(ca.certFile, certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Issues a certificate signed by the CA. Must be called with the CA loaded
+func (ca *InternalCA) issue(name string, usage x509.ExtKeyUsage, lifetime time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.DNSNames = []string{name}
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// Returns the client certificate presented to containers, renewing it once two thirds of its
+// lifetime have passed
+func (ca *InternalCA) clientCertificate() (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+	if ca.client != nil && time.Now().Before(ca.client.Leaf.NotAfter.Add(-clientCertLifetime/3)) {
+		return ca.client, nil
+	}
+
+	certPEM, keyPEM, err := ca.issue("container-paas", x509.ExtKeyUsageClientAuth, clientCertLifetime)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil, err
+	}
+	ca.client = &pair
+	return ca.client, nil
+}
+
+// ClientTLSConfig is the configuration used by the proxy to reach a container with mutual TLS.
+// Only certificates issued by the CA for serverName are accepted
+func (ca *InternalCA) ClientTLSConfig(serverName string) (*tls.Config, error) {
+	ca.mu.Lock()
+	err := ca.load()
+	pool := ca.pool
+	ca.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return ca.clientCertificate()
+		},
+	}, nil
+}
+
+// AppCertArchive issues a server certificate for a container and returns a tar archive of
+// tls.crt, tls.key, and ca.crt to copy into the container's certificate directory
+func (ca *InternalCA) AppCertArchive(name string) ([]byte, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := ca.issue(name, x509.ExtKeyUsageServerAuth, appCertLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	files := []struct {
+		name string
+		mode int64
+		data []byte
+	}{
+		{"tls.crt", 0644, certPEM},
+		{"tls.key", 0600, keyPEM},
+		{"ca.crt", 0644, ca.certPEM},
+	}
+	for _, f := range files {
+		header := &tar.Header{
+			Name:    f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.data)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Reads the files of a certificate archive, along with their modes
+func readCertArchive(t *testing.T, archive []byte) (map[string][]byte, map[string]int64) {
+	files := make(map[string][]byte)
+	modes := make(map[string]int64)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = b
+		modes[header.Name] = header.Mode
+	}
+	return files, modes
+}
+
+// Runs a handshake between an app serving its archived certificate and the proxy's client
+// configuration for serverName
+func mtlsHandshake(t *testing.T, ca *InternalCA, files map[string][]byte, serverName string) error {
+	pair, err := tls.X509KeyPair(files["tls.crt"], files["tls.key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	if !clients.AppendCertsFromPEM(files["ca.crt"]) {
+		t.Fatal("ca.crt holds no certificate")
+	}
+	clientConfig, err := ca.ClientTLSConfig(serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+		serverConn.Close()
+	}()
+
+	if err := tls.Client(clientConn, clientConfig).Handshake(); err != nil {
+		return err
+	}
+	return <-serverErr
+}
+
+func TestInternalCA(t *testing.T) {
+	testGlobal(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	ca := NewInternalCA(certFile, keyFile)
+
+	archive, err := ca.AppCertArchive("app-container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, modes := readCertArchive(t, archive)
+	if modes["tls.key"] != 0600 {
+		t.Errorf("tls.key mode = %o, want 600", modes["tls.key"])
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("CA key file = %v, %v, want mode 600", info, err)
+	}
+
+	// The app's certificate is issued by the CA for the container name, for serving only
+	block, _ := pem.Decode(files["tls.crt"])
+	if block == nil {
+		t.Fatal("tls.crt holds no certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(files["ca.crt"])
+	opts := x509.VerifyOptions{DNSName: "app-container", Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if _, err := leaf.Verify(opts); err != nil {
+		t.Errorf("app certificate doesn't verify: %v", err)
+	}
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if _, err := leaf.Verify(opts); err == nil {
+		t.Error("app certificate is valid for client authentication")
+	}
+
+	// Each side accepts the other's certificate, for the container's name only
+	if err := mtlsHandshake(t, ca, files, "app-container"); err != nil {
+		t.Errorf("handshake failed: %v", err)
+	}
+	if err := mtlsHandshake(t, ca, files, "other-container"); err == nil {
+		t.Error("handshake succeeded for another container's name")
+	}
+
+	first, err := ca.clientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ca.clientCertificate(); again != first {
+		t.Error("client certificate reissued before it needs renewal")
+	}
+
+	// A restarted server loads the same CA, so apps' certificates stay valid
+	reloaded := NewInternalCA(certFile, keyFile)
+	if err := mtlsHandshake(t, reloaded, files, "app-container"); err != nil {
+		t.Errorf("handshake with the reloaded CA failed: %v", err)
+	}
+}
+
+func TestInternalCAInvalidFiles(t *testing.T) {
+	testGlobal(t)
+	dir := t.TempDir()
+	writeTestCert(t, filepath.Join(dir, "leaf"), "leaf.example.com")
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"no files configured", "", ""},
+		{"key missing", filepath.Join(dir, "leaf.crt"), filepath.Join(dir, "missing.key")},
+		{"not a CA certificate", filepath.Join(dir, "leaf.crt"), filepath.Join(dir, "leaf.key")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewInternalCA(tt.certFile, tt.keyFile).AppCertArchive("app"); err == nil {
+				t.Error("certificate issued by an invalid CA")
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package internal
+
+// jwt.go
+// Validation of JSON Web Tokens against the keys in a JWKS file. Only the asymmetric
+// RS and ES algorithms are accepted, so tokens can't be forged by anyone holding the
+// public keys. The JWKS file is re-read when it changes so keys can be rotated
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidJWT = errors.New("Invalid token")
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// JWKS holds the public keys tokens are verified with
+type JWKS struct {
+	file *watchedFile
+	mu   sync.Mutex
+	keys []jwksKey
+}
+
+// Loads the JWKS file. Without a file no tokens are valid
+func NewJWKS(file string) (*JWKS, error) {
+	j := &JWKS{file: &watchedFile{path: file}}
+	if _, err := j.current(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *JWKS) Enabled() bool {
+	return j.file.path != ""
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseJWK(k *jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Unsupported curve: " + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.New("Unsupported key type: " + k.Kty)
+	}
+}
+
+// Returns the keys, re-reading the file if it changed. Keys which can't be used are skipped
+func (j *JWKS) current() ([]jwksKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	b, ok, err := j.file.changed()
+	if err != nil {
+		return j.keys, err
+	}
+	if ok {
+		set := &struct {
+			Keys []*jwk `json:"keys"`
+		}{}
+		if err := json.Unmarshal(b, set); err != nil {
+			return j.keys, err
+		}
+		keys := make([]jwksKey, 0, len(set.Keys))
+		for _, k := range set.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			key, err := parseJWK(k)
+			if err != nil {
+				continue
+			}
+			keys = append(keys, jwksKey{k.Kid, key})
+		}
+		j.keys = keys
+	}
+	return j.keys, nil
+}
+
+// jwtClaims holds the registered claims that are checked. The audience may be a string or a list
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(c.Audience, &list) == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks the signature of a signing input against a key using the algorithm
+func verifyJWTSignature(alg string, key crypto.PublicKey, input, signature []byte) bool {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(input)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(input)
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512(input)
+		digest = sum[:]
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	default:
+		return false
+	}
+}
+
+// Verify checks the token's signature and its exp, nbf, iss, and aud claims. An empty
+// issuer isn't checked, but the audience always is so tokens for one app can't be used
+// for another. Returns the token's subject
+func (j *JWKS) Verify(token, issuer, audience string) (string, error) {
+	keys, err := j.current()
+	if err != nil {
+		G.Logger.LogError(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidJWT
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errInvalidJWT
+	}
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(headerJSON, header); err != nil || len(header.Alg) != 5 {
+		return "", errInvalidJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidJWT
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	valid := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, k.key, input, signature) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", errInvalidJWT
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errInvalidJWT
+	}
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return "", errInvalidJWT
+	}
+
+	now := time.Now().Unix()
+	if claims.Expires == 0 || now >= claims.Expires {
+		return "", errors.New("Token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return "", errors.New("Token not yet valid")
+	}
+	if issuer != "" && claims.Issuer != issuer {
+		return "", errors.New("Token issuer not accepted")
+	}
+	if !claims.hasAudience(audience) {
+		return "", errors.New("Token audience not accepted")
+	}
+
+	return claims.Subject, nil
+}
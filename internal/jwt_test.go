@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Signs a token with the header and claims, using RS256 for RSA keys and ES256 for EC keys
+func signJWT(t *testing.T, key crypto.Signer, header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return input + "." + b64(signature)
+}
+
+func TestJWKSVerify(t *testing.T) {
+	testGlobal(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		// Encryption keys are never used to verify signatures
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(otherKey.N.Bytes()), "e": b64(big.NewInt(int64(otherKey.E)).Bytes())},
+	}})
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(file, set, 0644); err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := NewJWKS(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": "https://issuer", "aud": "app", "exp": now + 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	valid := signJWT(t, rsaKey, rs256, claims(nil))
+
+	tests := []struct {
+		name     string
+		token    string
+		issuer   string
+		audience string
+		wantErr  bool
+	}{
+		{"RS256", valid, "https://issuer", "app", false},
+		{"ES256", signJWT(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil)), "https://issuer", "app", false},
+		{"without kid", signJWT(t, rsaKey, map[string]interface{}{"alg": "RS256"}, claims(nil)), "https://issuer", "app", false},
+		{"issuer not checked", valid, "", "app", false},
+		{"audience list", signJWT(t, rsaKey, rs256, claims(map[string]interface{}{"aud": []string{"other", "app"}})), "", "app", false},
+		{"wrong kid", signJWT(t, rsaKey, map[string]interface{}{"alg": "RS256", "kid": "ec"}, claims(nil)), "", "app", true},
+		{"unknown key", signJWT(t, otherKey, rs256, claims(nil)), "", "app", true},
+		{"encryption key", signJWT(t, otherKey, map[string]interface{}{"alg": "RS256", "kid": "enc"}, claims(nil)), "", "app", true},
+		{"alg mismatch", signJWT(t, rsaKey, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, claims(nil)), "", "app", true},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + strings.Split(valid, ".")[1] + ".", "", "app", true},
+		{"HS256", signJWT(t, rsaKey, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil)), "", "app", true},
+		{"tampered claims", strings.Split(valid, ".")[0] + "." + b64([]byte(`{"sub":"mallory","aud":"app","exp":9999999999}`)) + "." + strings.Split(valid, ".")[2], "", "app", true},
+		{"two parts", strings.Join(strings.Split(valid, ".")[:2], "."), "", "app", true},
+		{"bad signature encoding", valid + "!", "", "app", true},
+		{"expired", signJWT(t, rsaKey, rs256, claims(map[string]interface{}{"exp": now - 1})), "", "app", true},
+		{"without exp", signJWT(t, rsaKey, rs256, claims(map[string]interface{}{"exp": nil})), "", "app", true},
+		{"not yet valid", signJWT(t, rsaKey, rs256, claims(map[string]interface{}{"nbf": now + 60})), "", "app", true},
+		{"wrong issuer", valid, "https://other", "app", true},
+		{"wrong audience", valid, "", "other", true},
+		{"without audience", signJWT(t, rsaKey, rs256, claims(map[string]interface{}{"aud": nil})), "", "app", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := jwks.Verify(tt.token, tt.issuer, tt.audience)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && sub != "alice" {
+				t.Errorf("Verify returned subject %q, want alice", sub)
+			}
+		})
+	}
+}
+
+// Apps are marshalled for the admin routes while their keys change, which must not race
+func TestAppAuthMarshalWhileIssuing(t *testing.T) {
+	auth := &AppAuth{Type: AppAuthAPIKey}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			key, _, err := auth.IssueKey()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			auth.RevokeKey(key.ID)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := json.Marshal(&App{ID: "app", Auth: auth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	b, err := json.Marshal(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"type":"apikey"}` {
+		t.Errorf("marshalled %s", b)
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+// limits.go
+// Per-app limits on requests proxied to containers. Requests with a body larger than the app's
+// maximum are rejected with a 413, and requests which take too long are cancelled with a 504.
+// Both are checked before a container is woken up whenever possible
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errBodyTooLarge          = errors.New("Request body too large")
+	errResponseHeaderTimeout = errors.New("Timeout awaiting response headers from app")
+)
+
+type bodyLimitKey struct{}
+
+// maxBodyReader returns an error once more than the allowed number of bytes are read.
+// The exceeded flag lets the proxy's error handler tell this apart from other body errors.
+// The transport reads the body in its own goroutine, so the flag is accessed atomically
+type maxBodyReader struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		atomic.StoreInt32(&m.exceeded, 1)
+		return 0, errBodyTooLarge
+	}
+	// Read one byte more than allowed, so a body of exactly the maximum size is accepted
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.ReadCloser.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		atomic.StoreInt32(&m.exceeded, 1)
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// Limits the size of the request body. The returned request must be used in place of r
+func limitRequestBody(r *http.Request, max int64) *http.Request {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r
+	}
+	body := &maxBodyReader{ReadCloser: r.Body, remaining: max}
+	r = r.WithContext(context.WithValue(r.Context(), bodyLimitKey{}, body))
+	r.Body = body
+	return r
+}
+
+// Indicates whether the request failed because its body was larger than allowed
+func bodyLimitExceeded(r *http.Request) bool {
+	body, ok := r.Context().Value(bodyLimitKey{}).(*maxBodyReader)
+	return ok && atomic.LoadInt32(&body.exceeded) == 1
+}
+
+// headerTimeoutTransport cancels requests which don't receive response headers within the timeout.
+// http2.Transport has no ResponseHeaderTimeout, so this is used for every protocol
+type headerTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *headerTimeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// The context can't be cancelled once headers arrive since the body is still being read.
+	// It is released when the parent request's context ends
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.next.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, errResponseHeaderTimeout
+	}
+	return resp, err
+}
+
+// Wraps the transport with a response header timeout. A timeout of 0 disables it
+func withResponseHeaderTimeout(next http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return next
+	}
+	return &headerTimeoutTransport{next, timeout}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		max      int64
+		exceeded bool
+	}{
+		{"under", "abc", 4, false},
+		{"exactly the maximum", "abcd", 4, false},
+		{"over", "abcde", 4, true},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := limitRequestBody(httptest.NewRequest("POST", "/", strings.NewReader(tt.body)), tt.max)
+
+			// The transport reads the body in its own goroutine while the proxy checks the flag
+			read := make(chan error)
+			go func() {
+				_, err := ioutil.ReadAll(r.Body)
+				read <- err
+			}()
+			_ = bodyLimitExceeded(r)
+			err := <-read
+
+			if (err == errBodyTooLarge) != tt.exceeded {
+				t.Errorf("read error = %v, exceeded %v", err, tt.exceeded)
+			}
+			if got := bodyLimitExceeded(r); got != tt.exceeded {
+				t.Errorf("bodyLimitExceeded = %v, want %v", got, tt.exceeded)
+			}
+		})
+	}
+}
@@ -1,8 +1,6 @@
 package internal
 
 import (
-	"bytes"
-	"errors"
 	"io"
 	"net/http"
 	"strconv"
@@ -18,52 +16,40 @@ const (
 	logLevelOff   LogLevel = 3
 )
 
-// loggedResponseWriter implements http.ResponseWriter, but records
-// anything written to it so that it can be recorded for logging
-// or caching.
-// TODO make this configurable based on log level to prevent unnecessary duplicated writes
+// loggedResponseWriter implements http.ResponseWriter, but records the
+// status and start time of the response for the access log. The body
+// is passed straight through, so large and streamed responses aren't
+// held in memory
 type loggedResponseWriter struct {
 	http.ResponseWriter
-	recorder io.Writer
 	status   int
-	headers  http.Header
 	reqStart time.Time
 }
 
 // Create a new loggedResponseWriter using the given ResponseWriter
-func logResponseWriter(w http.ResponseWriter, buf *bytes.Buffer) *loggedResponseWriter {
+func logResponseWriter(w http.ResponseWriter) *loggedResponseWriter {
 	return &loggedResponseWriter{
 		ResponseWriter: w,
-		recorder:       buf,
 		status:         200,
 		reqStart:       time.Now(),
 	}
 }
 
-func (l *loggedResponseWriter) Header() http.Header {
-	return l.ResponseWriter.Header()
+func (l *loggedResponseWriter) WriteHeader(statusCode int) {
+	l.ResponseWriter.WriteHeader(statusCode)
+	l.status = statusCode
 }
 
-func (l *loggedResponseWriter) Write(b []byte) (int, error) {
-	n, err := l.ResponseWriter.Write(b)
-	if err != nil {
-		return n, err
-	}
-	m, err := l.recorder.Write(b)
-	if err != nil {
-		return n, err
-	}
-
-	if n != m {
-		return 0, errors.New("loggedResponseWriter didn't write the same number of bytes")
+// Flush sends buffered data to the client, so streamed gRPC and SSE responses aren't held back
+func (l *loggedResponseWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
-
-	return n, nil
 }
 
-func (l *loggedResponseWriter) WriteHeader(statusCode int) {
-	l.ResponseWriter.WriteHeader(statusCode)
-	l.status = statusCode
+// Unwrap lets http.ResponseController reach the underlying writer
+func (l *loggedResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
 }
 
 // Logger is just a basic logger
@@ -81,8 +67,7 @@ func (log Logger) LogRequests(next http.Handler) http.Handler {
 			if log.level > 0 {
 				next.ServeHTTP(w, r)
 			} else {
-				var buf bytes.Buffer
-				loggedWriter := logResponseWriter(w, &buf)
+				loggedWriter := logResponseWriter(w)
 				next.ServeHTTP(loggedWriter, r)
 				log.LogAccess(loggedWriter, r)
 			}
@@ -114,7 +99,7 @@ func (log Logger) Info(message string) {
 
 func (log Logger) LogAccess(w *loggedResponseWriter, r *http.Request) {
 	if log.level < 1 {
-		remoteAddr := r.Header.Get("X-Forwarded-For")
+		remoteAddr := clientIP(r)
 		userAgent := r.Header.Get("User-Agent")
 		timing := int(time.Now().Sub(w.reqStart).Milliseconds())
 		// $remote_addr [$time_local] "$request" $path $status $http_user_agent $request_time
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogRequestsStreams(t *testing.T) {
+	testGlobal(t)
+	log := Logger{infoLog: ioutil.Discard, errorLog: ioutil.Discard}
+	done := make(chan struct{})
+
+	server := httptest.NewServer(log.LogRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first\n"))
+		// Reaches the connection through Unwrap
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write([]byte("second\n"))
+		w.(http.Flusher).Flush()
+		<-done
+	})))
+	defer server.Close()
+	defer close(done)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Both lines arrive while the handler is still running
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("line = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasn't flushed", want)
+		}
+	}
+}
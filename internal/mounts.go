@@ -0,0 +1,75 @@
+package internal
+
+// mounts.go
+// Policy for the host directories bind-mounted into app containers. A directory is only
+// mounted if, after resolving symlinks, it lies inside one of the allowed base directories.
+// Paths are resolved in the server's own filesystem, so when the server runs in a container
+// the allowed directories must be mounted into it at the same paths as on the host
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errMountNotAllowed = errors.New("Directory is outside of the allowed mount directories")
+
+// Canonicalizes the allowed base directories. Bases which don't exist are skipped
+// since nothing inside them could be mounted anyway
+func parseMountAllowlist(list string) ([]string, error) {
+	var bases []string
+	for _, base := range strings.Split(list, ",") {
+		base = strings.TrimSpace(base)
+		if base == "" {
+			continue
+		}
+		if !filepath.IsAbs(base) {
+			return nil, errors.New("Allowed mount directory must be absolute: " + base)
+		}
+		resolved, err := filepath.EvalSymlinks(filepath.Clean(base))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		bases = append(bases, resolved)
+	}
+	return bases, nil
+}
+
+// Resolves the directory requested for an app to its canonical path and checks it against
+// the allowlist. An empty directory means nothing is mounted
+func resolveMountDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+
+	if !filepath.IsAbs(dir) {
+		return "", errors.New("Directory must be an absolute path: " + dir)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(dir))
+	if err != nil {
+		return "", errors.New("Directory does not exist: " + dir)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New("Not a directory: " + dir)
+	}
+
+	for _, base := range G.MountAllow {
+		rel, err := filepath.Rel(base, resolved)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", errMountNotAllowed
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveMountDir(t *testing.T) {
+	g := testGlobal(t)
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(root, "allowed")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(allowed, "app"), allowed + "-other", outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(allowed, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(allowed, "app"), filepath.Join(root, "link-in")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "link-out")); err != nil {
+		t.Fatal(err)
+	}
+	g.MountAllow = []string{allowed}
+
+	tests := []struct {
+		name    string
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "", false},
+		{"base", allowed, allowed, false},
+		{"inside", filepath.Join(allowed, "app"), filepath.Join(allowed, "app"), false},
+		{"unclean", allowed + "/./app/", filepath.Join(allowed, "app"), false},
+		{"symlink into allowlist", filepath.Join(root, "link-in"), filepath.Join(allowed, "app"), false},
+		{"relative", "allowed/app", "", true},
+		{"missing", filepath.Join(allowed, "missing"), "", true},
+		{"file", filepath.Join(allowed, "file"), "", true},
+		{"outside", outside, "", true},
+		{"dot dot", filepath.Join(allowed, "..", "outside"), "", true},
+		{"symlink out of allowlist", filepath.Join(allowed, "link-out"), "", true},
+		{"sibling with base as prefix", allowed + "-other", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveMountDir(tt.dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveMountDir(%q) error = %v, wantErr %v", tt.dir, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveMountDir(%q) = %q, want %q", tt.dir, got, tt.want)
+			}
+		})
+	}
+
+	// A directory swapped for a symlink after it was checked no longer resolves inside the allowlist
+	dir := filepath.Join(allowed, "app")
+	if _, err := resolveMountDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveMountDir(dir); err != errMountNotAllowed {
+		t.Errorf("resolveMountDir after the swap: error = %v, want %v", err, errMountNotAllowed)
+	}
+}
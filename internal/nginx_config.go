@@ -0,0 +1,308 @@
+package internal
+
+// nginx_config.go
+// nginxConfig manages the conf files of the nginx ingresses. Changes are staged in memory and
+// only reach the live directory once they pass nginx -t: a check copies the live conf files
+// into a temp directory, applies the staged changes there, and tests a copy of the main
+// configuration which includes the temp directory instead. Files which pass are written
+// atomically through a temp file, so nginx never reads half of a file, and nginx is reloaded.
+//
+// Changes staged by concurrent requests are checked and reloaded together in a batch, so
+// removing every app at shutdown, or many apps changing at once, only reloads nginx once. If a
+// batch fails the check, each change is checked on its own, the failing ones are dropped, and
+// the rest are still applied. Each caller learns whether its own change was applied
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Main nginx configuration, which includes the conf files of the apps
+const nginxMainConf = "/etc/nginx/nginx.conf"
+
+type nginxConfig struct {
+	dir      string
+	mainConf string // Main configuration, which must include the conf files in dir
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string][]byte      // Staged content of each changed file. nil removes the file
+	batchOf map[string]*nginxBatch // Batch each staged change is applied in, until its caller collects the result
+	next    *nginxBatch            // Batch the staged changes are applied in
+	running bool                   // Whether a batch is being checked and applied
+}
+
+// Changes applied together by a single reload
+type nginxBatch struct {
+	finished bool
+	rejected map[string]error // Why each rejected change failed the check
+	err      error            // Failure of the whole batch, such as a failed reload
+}
+
+func newNginxConfig(dir string) *nginxConfig {
+	c := &nginxConfig{
+		dir:      dir,
+		mainConf: nginxMainConf,
+		pending:  make(map[string][]byte),
+		batchOf:  make(map[string]*nginxBatch),
+		next:     &nginxBatch{},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Path of the conf file for an app
+func (c *nginxConfig) file(id string) string {
+	return path.Join(c.dir, id+".conf")
+}
+
+// Stages new content for a file
+func (c *nginxConfig) write(file string, content []byte) error {
+	if content == nil {
+		content = []byte{}
+	}
+	c.stage(file, content)
+	return nil
+}
+
+// Stages the removal of a file. Removing a file which doesn't exist is not an error
+func (c *nginxConfig) remove(file string) error {
+	c.stage(file, nil)
+	return nil
+}
+
+func (c *nginxConfig) stage(file string, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[file] = content
+	c.batchOf[file] = c.next
+}
+
+// Writes content to a temp file beside the file, then renames it into place. The temp file
+// doesn't end in .conf, so nginx never includes it
+func writeFileAtomic(file string, content []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Applies the staged change to file, together with any other staged changes, and returns the
+// files whose changes were rejected. An empty file waits for every change staged so far. The
+// error describes why the caller's changes weren't applied
+func (c *nginxConfig) apply(file string) (rejected []string, err error) {
+	c.mu.Lock()
+	b := c.next
+	if file != "" {
+		if staged, ok := c.batchOf[file]; ok {
+			b = staged
+			delete(c.batchOf, file)
+		}
+	}
+
+	// Wait for the running batch. The first caller of the next batch to wake up runs it
+	for c.running && !b.finished {
+		c.cond.Wait()
+	}
+	if !b.finished {
+		changes := c.pending
+		c.pending = make(map[string][]byte)
+		c.next = &nginxBatch{}
+		c.running = true
+		c.mu.Unlock()
+
+		rejected, err := c.run(changes)
+
+		c.mu.Lock()
+		b.rejected, b.err = rejected, err
+		b.finished = true
+		c.running = false
+		c.cond.Broadcast()
+	}
+	if file == "" {
+		// Results of earlier batches are no longer collected by anyone
+		for f, staged := range c.batchOf {
+			if staged.finished {
+				delete(c.batchOf, f)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	return b.result(file)
+}
+
+// Result of the batch for the change to file, or for every change if file is empty
+func (b *nginxBatch) result(file string) ([]string, error) {
+	if file != "" {
+		if err, ok := b.rejected[file]; ok {
+			return []string{file}, err
+		}
+		return nil, b.err
+	}
+
+	var rejected []string
+	var msgs []string
+	for f, err := range b.rejected {
+		rejected = append(rejected, f)
+		msgs = append(msgs, err.Error())
+	}
+	if b.err != nil {
+		msgs = append(msgs, b.err.Error())
+	}
+	if len(msgs) > 0 {
+		return rejected, errors.New(strings.Join(msgs, "; "))
+	}
+	return rejected, nil
+}
+
+// Checks the changes, writes the ones which pass into the live directory, and reloads nginx.
+// Returns the changes which were rejected, with the reason for each
+func (c *nginxConfig) run(changes map[string][]byte) (map[string]error, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	rejected := make(map[string]error)
+	if err := c.check(changes); err != nil {
+		if len(changes) == 1 {
+			for file := range changes {
+				rejected[file] = err
+			}
+			return rejected, nil
+		}
+
+		// Find the changes which fail on their own, so the others can still be applied
+		passed := make(map[string][]byte)
+		for file, content := range changes {
+			if err := c.check(map[string][]byte{file: content}); err != nil {
+				rejected[file] = err
+			} else {
+				passed[file] = content
+			}
+		}
+		if len(passed) > 1 {
+			if err := c.check(passed); err != nil {
+				for file := range passed {
+					rejected[file] = err
+				}
+				passed = nil
+			}
+		}
+		changes = passed
+	}
+	if len(changes) == 0 {
+		return rejected, nil
+	}
+
+	for file, content := range changes {
+		var err error
+		if content == nil {
+			if err = os.Remove(file); os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeFileAtomic(file, content, 0664)
+		}
+		if err != nil {
+			return rejected, err
+		}
+	}
+
+	if out, err := exec.Command("nginx", "-s", "reload").CombinedOutput(); err != nil {
+		return rejected, errors.New("Could not reload nginx: " + commandOutput(out, err))
+	}
+	return rejected, nil
+}
+
+// Tests the live configuration with the changes applied, without touching the live files
+func (c *nginxConfig) check(changes map[string][]byte) error {
+	main, err := ioutil.ReadFile(c.mainConf)
+	if err != nil {
+		return err
+	}
+	include := []byte(strings.TrimSuffix(c.dir, "/") + "/")
+	if !bytes.Contains(main, include) {
+		return errors.New(c.mainConf + " doesn't include the conf files in " + c.dir)
+	}
+
+	staging, err := ioutil.TempDir(path.Dir(c.dir), "."+path.Base(c.dir)+".check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range files {
+		file := path.Join(c.dir, info.Name())
+		if _, changed := changes[file]; changed || info.IsDir() || !strings.HasSuffix(info.Name(), ".conf") {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(staging, info.Name()), b, 0664); err != nil {
+			return err
+		}
+	}
+	for file, content := range changes {
+		if content == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(path.Join(staging, path.Base(file)), content, 0664); err != nil {
+			return err
+		}
+	}
+
+	// Beside the main configuration, so its relative paths resolve the same way
+	tmp, err := ioutil.TempFile(path.Dir(c.mainConf), "."+path.Base(c.mainConf)+".*.check")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(bytes.Replace(main, include, []byte(staging+"/"), -1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("nginx", "-t", "-c", tmp.Name()).CombinedOutput(); err != nil {
+		return errors.New("Invalid nginx configuration, the change was not applied: " + commandOutput(out, err))
+	}
+	return nil
+}
+
+// Describes a failed command using its output
+func commandOutput(out []byte, err error) string {
+	msg := string(bytes.Replace(bytes.TrimSpace(out), []byte("\n"), []byte("; "), -1))
+	if msg == "" {
+		return err.Error()
+	}
+	return msg
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Puts a fake nginx first in PATH. nginx -t fails if any conf file included by the tested
+// configuration contains "invalid", and each reload is recorded in the returned log file
+func fakeNginx(t *testing.T) (mainConf, appDir, reloadLog string) {
+	dir := t.TempDir()
+	appDir = filepath.Join(dir, "apps")
+	if err := os.Mkdir(appDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mainConf = filepath.Join(dir, "nginx.conf")
+	if err := ioutil.WriteFile(mainConf, []byte("http {\n    include "+appDir+"/*.conf;\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadLog = filepath.Join(dir, "reloads")
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+if [ "$1" = "-t" ]; then
+    dir=$(sed -n 's|.*include \(.*\)/\*\.conf;.*|\1|p' "$3")
+    if cat "$dir"/*.conf 2>/dev/null | grep -q invalid; then
+        echo "nginx: [emerg] unknown directive \"invalid\"" >&2
+        exit 1
+    fi
+    exit 0
+fi
+echo "$@" >> ` + reloadLog + "\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "nginx"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	return mainConf, appDir, reloadLog
+}
+
+func reloadCount(t *testing.T, reloadLog string) int {
+	b, err := ioutil.ReadFile(reloadLog)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "reload")
+}
+
+func readFile(t *testing.T, file string) string {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNginxConfigApply(t *testing.T) {
+	testGlobal(t)
+
+	tests := []struct {
+		name        string
+		live        map[string]string // Conf files before the changes
+		changes     map[string]string // Staged changes. <remove> removes the file
+		wantErr     map[string]bool   // Changes whose caller gets an error
+		want        map[string]string // Conf files afterwards
+		wantReloads int
+	}{
+		{
+			name:        "valid change",
+			live:        map[string]string{"app": "server v1"},
+			changes:     map[string]string{"app": "server v2"},
+			want:        map[string]string{"app": "server v2"},
+			wantReloads: 1,
+		},
+		{
+			name:    "invalid change is rolled back",
+			live:    map[string]string{"app": "server v1"},
+			changes: map[string]string{"app": "invalid"},
+			wantErr: map[string]bool{"app": true},
+			want:    map[string]string{"app": "server v1"},
+		},
+		{
+			name:        "removal",
+			live:        map[string]string{"app": "server v1", "other": "server"},
+			changes:     map[string]string{"app": "<remove>"},
+			want:        map[string]string{"app": "<missing>", "other": "server"},
+			wantReloads: 1,
+		},
+		{
+			name:        "batch with one invalid change",
+			live:        map[string]string{"old": "server v1"},
+			changes:     map[string]string{"old": "server v2", "new": "server", "bad": "invalid"},
+			wantErr:     map[string]bool{"bad": true},
+			want:        map[string]string{"old": "server v2", "new": "server", "bad": "<missing>"},
+			wantReloads: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mainConf, appDir, reloadLog := fakeNginx(t)
+			for id, content := range tt.live {
+				if err := ioutil.WriteFile(filepath.Join(appDir, id+".conf"), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := newNginxConfig(appDir)
+			c.mainConf = mainConf
+			for id, content := range tt.changes {
+				if content == "<remove>" {
+					_ = c.remove(c.file(id))
+				} else {
+					_ = c.write(c.file(id), []byte(content))
+				}
+				// Staged changes stay out of the live directory until they pass the check
+				if got := readFile(t, c.file(id)); got != tt.live[id] && !(got == "<missing>" && tt.live[id] == "") {
+					t.Errorf("%s changed to %q before the check", id, got)
+				}
+			}
+
+			// Each caller applies its own change, concurrently, as admin requests do
+			var wg sync.WaitGroup
+			errs := make(map[string]error)
+			var mu sync.Mutex
+			for id := range tt.changes {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					_, err := c.apply(c.file(id))
+					mu.Lock()
+					errs[id] = err
+					mu.Unlock()
+				}(id)
+			}
+			wg.Wait()
+
+			for id := range tt.changes {
+				if (errs[id] != nil) != tt.wantErr[id] {
+					t.Errorf("%s: apply error = %v, wantErr %v", id, errs[id], tt.wantErr[id])
+				}
+			}
+			for id, want := range tt.want {
+				if got := readFile(t, c.file(id)); got != want {
+					t.Errorf("%s = %q, want %q", id, got, want)
+				}
+			}
+			if got := reloadCount(t, reloadLog); got != tt.wantReloads {
+				t.Errorf("reloads = %d, want %d", got, tt.wantReloads)
+			}
+
+			// The temp copies used for the check are removed
+			entries, err := ioutil.ReadDir(filepath.Dir(appDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), ".") {
+					t.Errorf("check left %s behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestNginxPortsRejectedChange(t *testing.T) {
+	g := testGlobal(t)
+	g.Addr = "localhost:3000"
+	mainConf, appDir, _ := fakeNginx(t)
+
+	// Renders an invalid server block for apps with domains
+	templateFile := filepath.Join(t.TempDir(), "nginx.tmpl")
+	text := "server { listen {{ .Port }}; {{ if .App.Domains }}invalid{{ end }} }"
+	if err := ioutil.WriteFile(templateFile, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNginxPorts(appDir, 5000, 5001, templateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.conf.mainConf = mainConf
+
+	app := &App{ID: "app"}
+	if _, err := n.Write(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.reloadApp(app); err != nil {
+		t.Fatal(err)
+	}
+	port := n.ports.ports["app"]
+
+	// A redeploy failing the check keeps the app's live conf file and port
+	if _, err := n.Write(&App{ID: "app", Domains: []string{"app.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.reloadApp(app); err == nil {
+		t.Fatal("expected the redeploy to be rejected")
+	}
+	if got := n.ports.ports["app"]; got != port {
+		t.Errorf("port after rejected redeploy = %d, want %d", got, port)
+	}
+	if _, ok := n.apps["app"]; !ok {
+		t.Error("app dropped after rejected redeploy")
+	}
+
+	// A new app failing the check gives its port back
+	bad := &App{ID: "bad", Domains: []string{"bad.example.com"}}
+	if _, err := n.Write(bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.reloadApp(bad); err == nil {
+		t.Fatal("expected the new app to be rejected")
+	}
+	if _, ok := n.ports.ports["bad"]; ok {
+		t.Error("rejected app kept its port")
+	}
+	if _, ok := n.apps["bad"]; ok {
+		t.Error("rejected app kept its entry")
+	}
+}
@@ -0,0 +1,173 @@
+package internal
+
+// nginx_hosts.go
+// NginxHosts is an nginx ingress which serves every app on a single port, using a virtual
+// host named <id>.<domain> for each app along with the app's custom domains. Unlike
+// NginxPorts the number of apps isn't limited by a port range, and only one port needs to be
+// published. nginx can't serve HTTP/1.1 and cleartext HTTP/2 on the same port, so gRPC apps
+// are served on a second port
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// App IDs are used as the first label of the app's hostname, in URLs and nginx server_name
+var hostLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type NginxHosts struct {
+	NginxAppDir string
+	Domain      string // Apps are served at <id>.<Domain>
+	Port        int    // Port every app is served on
+	GRPCPort    int    // Port gRPC apps are served on. 0 means gRPC apps can't be served
+	conf        *nginxConfig
+	confMu      *sync.Mutex
+	tmpl        *ingressTemplate
+	apps        map[string]string
+}
+
+// Creates the ingress. The template file replaces the built-in server block when one is given
+func NewNginxHosts(appDir, domain string, port, grpcPort int, templateFile string) (*NginxHosts, error) {
+	if domain == "" {
+		return nil, errors.New("Hostname-based nginx ingress requires an app domain")
+	}
+	tmpl, err := newIngressTemplate("nginx", nginxTemplate, templateFile)
+	if err != nil {
+		return nil, err
+	}
+	n := &NginxHosts{
+		NginxAppDir: appDir,
+		Domain:      domain,
+		Port:        port,
+		GRPCPort:    grpcPort,
+		conf:        newNginxConfig(appDir),
+		confMu:      &sync.Mutex{},
+		tmpl:        tmpl,
+	}
+
+	n.confMu.Lock()
+	defer n.confMu.Unlock()
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Rebuilds the apps from the conf files, so files left by a previous run can be removed.
+// Must be called with the lock held
+func (n *NginxHosts) load() error {
+	n.apps = make(map[string]string)
+
+	files, err := ioutil.ReadDir(n.NginxAppDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range files {
+		id := strings.TrimSuffix(info.Name(), ".conf")
+		if !info.IsDir() && id != info.Name() && appIDPattern.MatchString(id) {
+			n.apps[id] = n.conf.file(id)
+		}
+	}
+	return nil
+}
+
+// Rejects app IDs which aren't valid hostname labels, such as IDs with underscores or uppercase letters
+func (*NginxHosts) checkAppID(id string) error {
+	if !hostLabelPattern.MatchString(id) {
+		return errors.New("App id must be a valid hostname label with the hostname-based nginx ingress, " +
+			"using only lowercase letters, digits and hyphens: " + id)
+	}
+	return nil
+}
+
+// Write a virtual host for the app and return its URL
+func (n *NginxHosts) Write(app *App) (string, error) {
+	if err := n.checkAppID(app.ID); err != nil {
+		return "", err
+	}
+
+	port := n.Port
+	if isHTTP2(app.Protocol) {
+		if n.GRPCPort == 0 {
+			return "", errors.New("The ingress has no port for gRPC apps")
+		}
+		port = n.GRPCPort
+	}
+
+	b, err := renderNginx(n.tmpl, app, port, appHosts(app, n.Domain))
+	if err != nil {
+		return "", err
+	}
+
+	file := n.conf.file(app.ID)
+	if err := n.conf.write(file, b); err != nil {
+		return "", err
+	}
+
+	n.confMu.Lock()
+	n.apps[app.ID] = file
+	n.confMu.Unlock()
+
+	host := app.ID + "." + n.Domain
+	if port != 80 {
+		host += ":" + strconv.Itoa(port)
+	}
+	return "http://" + host, nil
+}
+
+// Remove the virtual host of the app
+func (n *NginxHosts) Remove(app *App) error {
+	n.confMu.Lock()
+	defer n.confMu.Unlock()
+
+	if file, ok := n.apps[app.ID]; ok {
+		if err := n.conf.remove(file); err != nil {
+			return err
+		}
+		delete(n.apps, app.ID)
+	}
+	return nil
+}
+
+// Applies every staged change with a single reload. Apps whose changes were rejected are
+// rebuilt from their conf files
+func (n *NginxHosts) Reload() error {
+	rejected, err := n.conf.apply("")
+	n.restore(rejected)
+	return err
+}
+
+// Applies the app's change together with any concurrent changes, and reports whether the
+// app's change was applied
+func (n *NginxHosts) reloadApp(app *App) error {
+	rejected, err := n.conf.apply(n.conf.file(app.ID))
+	n.restore(rejected)
+	return err
+}
+
+// Rebuilds the apps whose changes were rejected from their live conf files
+func (n *NginxHosts) restore(files []string) {
+	if len(files) == 0 {
+		return
+	}
+	n.confMu.Lock()
+	defer n.confMu.Unlock()
+
+	for _, file := range files {
+		id := strings.TrimSuffix(path.Base(file), ".conf")
+		if _, err := os.Stat(file); err == nil {
+			n.apps[id] = file
+		} else {
+			delete(n.apps, id)
+		}
+	}
+}
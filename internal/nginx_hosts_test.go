@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNginxHostsAppIDs(t *testing.T) {
+	testGlobal(t)
+	dir := t.TempDir()
+	n, err := NewNginxHosts(dir, "apps.example.com", 80, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{"app", false},
+		{"my-app-2", false},
+		{"a", false},
+		{strings.Repeat("a", 63), false},
+		{"my_app", true},
+		{"MyApp", true},
+		{"-app", true},
+		{"app-", true},
+		{strings.Repeat("a", 64), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			u, err := n.Write(&App{ID: tt.id})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, staged := n.conf.pending[filepath.Join(dir, tt.id+".conf")]
+			if staged == tt.wantErr {
+				t.Errorf("conf file staged = %v for id %q", staged, tt.id)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := "http://" + tt.id + ".apps.example.com"; u != want {
+				t.Errorf("url = %q, want %q", u, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNginxPortsWriteFailureReleasesPort(t *testing.T) {
+	g := testGlobal(t)
+	g.Addr = "localhost:3000"
+
+	// Fails to render for apps with domains
+	dir := t.TempDir()
+	templateFile := filepath.Join(dir, "nginx.tmpl")
+	text := "server { listen {{ .Port }}; {{ if .App.Domains }}{{ template \"missing\" }}{{ end }} }"
+	if err := ioutil.WriteFile(templateFile, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNginxPorts(t.TempDir(), 5000, 5001, templateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.Write(&App{ID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	port := n.ports.ports["app"]
+
+	tests := []struct {
+		name     string
+		app      *App
+		wantPort bool
+	}{
+		{"new app", &App{ID: "new", Domains: []string{"new.example.com"}}, false},
+		{"redeployed app", &App{ID: "app", Domains: []string{"app.example.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := n.Write(tt.app); err == nil {
+				t.Fatal("expected the write to fail")
+			}
+			_, reserved := n.ports.ports[tt.app.ID]
+			if reserved != tt.wantPort {
+				t.Errorf("port reserved = %v, want %v", reserved, tt.wantPort)
+			}
+		})
+	}
+	if got := n.ports.ports["app"]; got != port {
+		t.Errorf("redeployed app's port = %d, want %d", got, port)
+	}
+
+	// The failed app's port is free for another app
+	if _, err := n.Write(&App{ID: "other"}); err != nil {
+		t.Errorf("second port not free: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+// nginx_template.go
+// The server block written for each app by the nginx ingresses. A single template covers both
+// modes and both kinds of apps: hosts mode adds server_name, and gRPC apps are served over
+// HTTP/2 with grpc_pass. Operators can replace it with -ingress-template. A replacement must
+// keep "listen {{ .Port }}" in ports mode, since the ports of apps are read back from it
+import (
+	"net/url"
+	"strings"
+)
+
+const nginxTemplate = `server {
+	listen {{ .Port }}{{ if .HTTP2 }} http2{{ end }};
+{{- if .ServerNames }}
+	server_name {{ .ServerNames }};
+{{- end }}
+	client_max_body_size {{ .App.MaxBodySize }};
+
+	location / {
+{{- if .HTTP2 }}
+		# grpc_pass can't take a path, so the app prefix is added with a rewrite
+		rewrite ^(.*)$ {{ .Prefix }}$1 break;
+		grpc_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+		grpc_set_header X-Forwarded-Proto $scheme;
+		grpc_set_header X-Forwarded-Host $http_host;
+		grpc_set_header X-Forwarded-Prefix /;
+{{- if .App.Timeout }}
+		grpc_read_timeout {{ seconds .App.Timeout }}s;
+		grpc_send_timeout {{ seconds .App.Timeout }}s;
+{{- end }}
+{{- else }}
+		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+		proxy_set_header X-Forwarded-Proto $scheme;
+		proxy_set_header X-Forwarded-Host $http_host;
+		proxy_set_header X-Forwarded-Prefix /;
+{{- if .App.Timeout }}
+		proxy_read_timeout {{ seconds .App.Timeout }}s;
+		proxy_send_timeout {{ seconds .App.Timeout }}s;
+{{- end }}
+{{- end }}
+{{- if .HTTP2 }}
+		grpc_pass grpc://{{ .Addr }};
+{{- else }}
+		proxy_pass {{ .Url }}/;
+{{- end }}
+	}
+}
+`
+
+// Data available to the nginx template, in addition to the common ingress template data
+type nginxTemplateData struct {
+	ingressTemplateData
+	Port        int    // Port nginx serves the app on
+	ServerNames string // Virtual host names of the app in hosts mode. Empty in ports mode
+	Url         string // URL of the app on this server, including the /app/<id> prefix
+}
+
+// Renders the server block for an app
+func renderNginx(tmpl *ingressTemplate, app *App, port int, serverNames []string) ([]byte, error) {
+	frontend, err := url.Parse("http://" + G.Addr + "/app/" + app.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := serverNames
+	if hosts == nil {
+		hosts = app.Domains
+	}
+
+	return tmpl.execute(nginxTemplateData{
+		ingressTemplateData: newIngressTemplateData(app, hosts, G.Addr),
+		Port:                port,
+		ServerNames:         strings.Join(serverNames, " "),
+		Url:                 frontend.String(),
+	})
+}
@@ -0,0 +1,140 @@
+package internal
+
+// ports.go
+// portAllocator hands out ports from a range to owners such as apps. An owner keeps its port
+// until it is released, and gets the same port back afterwards as long as no one else took
+// it, so an app which is redeployed keeps its port. New owners are given ports which were
+// never used before where possible, to keep the ports of released owners free for them
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type portAllocator struct {
+	mu      sync.Mutex
+	min     int
+	max     int
+	owners  map[int]string // Port to the owner using it
+	ports   map[string]int // Owner to the port it uses
+	history map[string]int // Owner to the last port it used
+	taken   map[int]bool   // Ports which have been used by any owner
+}
+
+func newPortAllocator(min, max int) *portAllocator {
+	return &portAllocator{
+		min:     min,
+		max:     max,
+		owners:  make(map[int]string),
+		ports:   make(map[string]int),
+		history: make(map[string]int),
+		taken:   make(map[int]bool),
+	}
+}
+
+// Parses a port range like 5000-5099
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid port range: " + s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.New("Invalid port range: " + s)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, errors.New("Invalid port range: " + s)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.New("Invalid port range: " + s)
+	}
+	return min, max, nil
+}
+
+func (a *portAllocator) size() int {
+	return a.max - a.min + 1
+}
+
+// Must be called with the lock held
+func (a *portAllocator) assign(owner string, port int) {
+	a.owners[port] = owner
+	a.ports[owner] = port
+	a.history[owner] = port
+	a.taken[port] = true
+}
+
+// Returns the owner's port, reserving one if it has none. Returns false if every port is in use
+func (a *portAllocator) reserve(owner string) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port, ok := a.ports[owner]; ok {
+		return port, true
+	}
+	if port, ok := a.history[owner]; ok {
+		if _, used := a.owners[port]; !used {
+			a.assign(owner, port)
+			return port, true
+		}
+	}
+	if len(a.owners) >= a.size() {
+		return 0, false
+	}
+
+	// Search from a random port, wrapping around the end of the range. The first pass skips
+	// ports which other owners may want back
+	start := rand.Intn(a.size())
+	for _, skipTaken := range []bool{true, false} {
+		for i := 0; i < a.size(); i++ {
+			port := a.min + (start+i)%a.size()
+			if _, used := a.owners[port]; used || (skipTaken && a.taken[port]) {
+				continue
+			}
+			a.assign(owner, port)
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// Gives the owner a specific port, such as one found in existing configuration. Returns false
+// if the port is outside the range or used by another owner
+func (a *portAllocator) claim(owner string, port int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port < a.min || port > a.max {
+		return false
+	}
+	if current, used := a.owners[port]; used && current != owner {
+		return false
+	}
+	if previous, ok := a.ports[owner]; ok {
+		delete(a.owners, previous)
+	}
+	a.assign(owner, port)
+	return true
+}
+
+// Frees every port, but remembers the last port of each owner
+func (a *portAllocator) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.owners = make(map[int]string)
+	a.ports = make(map[string]int)
+}
+
+// Frees the owner's port. The owner gets it back on its next reservation if it is still free
+func (a *portAllocator) release(owner string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port, ok := a.ports[owner]; ok {
+		delete(a.owners, port)
+		delete(a.ports, owner)
+	}
+}
@@ -0,0 +1,166 @@
+package internal
+
+// rate_limit.go
+// Token bucket rate limiting for requests sent to apps. Each app may allow a number of
+// requests per second with a burst, shared by every client or kept separately per client
+// IP or per API key. Limited requests receive a 429 before the container is woken up, and
+// every response carries RateLimit-Limit, RateLimit-Remaining, and RateLimit-Reset headers
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitKeyApp    = ""       // One bucket shared by every client of the app
+	RateLimitKeyIP     = "ip"     // One bucket per client IP
+	RateLimitKeyAPIKey = "apikey" // One bucket per API key, or per authenticated user with other auth types
+)
+
+// Buckets kept per app. Past this the least recently used bucket is evicted, so clients
+// can't exhaust memory or slow down every request by sending from many addresses
+const maxRateLimitBuckets = 10000
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit is an app's rate limit and the state of its buckets
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // Requests allowed per second
+	Burst int     `json:"burst"` // Requests allowed at once, the size of each bucket
+	Key   string  `json:"key"`   // What requests are grouped by: "" for the whole app, "ip", or "apikey"
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element // Elements of lru holding each key's bucket
+	lru     *list.List               // Buckets from the most to the least recently used
+}
+
+// rateLimitRequest configures the rate limit when creating an app
+type rateLimitRequest struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Key   string  `json:"key"`
+}
+
+// Creates the rate limit for an app. A nil request means the app isn't limited. Keying
+// by API key requires the app to authenticate its callers
+func newRateLimit(req *rateLimitRequest, auth *AppAuth) (*RateLimit, error) {
+	if req == nil {
+		return nil, nil
+	}
+	if req.Rate <= 0 || math.IsInf(req.Rate, 0) || math.IsNaN(req.Rate) {
+		return nil, errors.New("Rate limit must be a positive number of requests per second")
+	}
+
+	burst := req.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(req.Rate))
+	}
+	if burst < 1 {
+		return nil, errors.New("Rate limit burst must be positive")
+	}
+
+	switch req.Key {
+	case RateLimitKeyApp, RateLimitKeyIP:
+	case RateLimitKeyAPIKey:
+		if auth == nil {
+			return nil, errors.New("Rate limiting by API key requires the app to use authentication")
+		}
+	default:
+		return nil, errors.New("Unsupported rate limit key: " + req.Key)
+	}
+
+	return &RateLimit{
+		Rate:    req.Rate,
+		Burst:   burst,
+		Key:     req.Key,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// Whether the request's bucket depends on who sent it, so the limit can only be applied after authentication
+func (l *RateLimit) byIdentity() bool {
+	return l.Key == RateLimitKeyAPIKey
+}
+
+// Returns the bucket a request belongs to. invoker is the identity returned by the app's authentication
+func (l *RateLimit) bucketKey(r *http.Request, invoker string) string {
+	switch l.Key {
+	case RateLimitKeyIP:
+		return clientIP(r)
+	case RateLimitKeyAPIKey:
+		return invoker
+	default:
+		return ""
+	}
+}
+
+// Returns the key's bucket, creating a full one if it doesn't exist. Must be called with the lock held
+func (l *RateLimit) bucket(key string, now time.Time) (b *tokenBucket, ok bool) {
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*tokenBucket), true
+	}
+
+	if l.lru.Len() >= maxRateLimitBuckets {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*tokenBucket).key)
+	}
+	b = &tokenBucket{key: key, tokens: float64(l.Burst), last: now}
+	l.buckets[key] = l.lru.PushFront(b)
+	return b, false
+}
+
+// Takes a token from the request's bucket. Returns whether the request is allowed, the
+// tokens left, and the time until the bucket is full again, or until the next token
+// is available if the request is refused
+func (l *RateLimit) take(key string) (bool, int, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.bucket(key, now)
+	if ok {
+		b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	full := time.Duration((float64(l.Burst) - b.tokens) / l.Rate * float64(time.Second))
+	return true, int(b.tokens), full
+}
+
+// Whole seconds, rounded up so clients never retry too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// Allow takes a token for the request and sets the RateLimit headers on the response.
+// If the request is refused Retry-After is set as well, and false is returned
+func (l *RateLimit) Allow(w http.ResponseWriter, r *http.Request, invoker string) bool {
+	ok, remaining, reset := l.take(l.bucketKey(r, invoker))
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(l.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(reset))
+	if !ok {
+		h.Set("Retry-After", ceilSeconds(reset))
+	}
+	return ok
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNewRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       *rateLimitRequest
+		auth      *AppAuth
+		wantBurst int
+		wantErr   bool
+	}{
+		{"none", nil, nil, 0, false},
+		{"default burst", &rateLimitRequest{Rate: 2.5}, nil, 3, false},
+		{"burst", &rateLimitRequest{Rate: 1, Burst: 10, Key: RateLimitKeyIP}, nil, 10, false},
+		{"apikey with auth", &rateLimitRequest{Rate: 1, Key: RateLimitKeyAPIKey}, &AppAuth{Type: AppAuthAPIKey}, 1, false},
+		{"apikey without auth", &rateLimitRequest{Rate: 1, Key: RateLimitKeyAPIKey}, nil, 0, true},
+		{"zero rate", &rateLimitRequest{}, nil, 0, true},
+		{"negative burst", &rateLimitRequest{Rate: 1, Burst: -1}, nil, 0, true},
+		{"unknown key", &rateLimitRequest{Rate: 1, Key: "cookie"}, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newRateLimit(tt.req, tt.auth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newRateLimit error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr || tt.req == nil {
+				if l != nil {
+					t.Errorf("newRateLimit returned a limit")
+				}
+				return
+			}
+			if l.Burst != tt.wantBurst {
+				t.Errorf("burst = %d, want %d", l.Burst, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	testGlobal(t)
+
+	tests := []struct {
+		name     string
+		key      string
+		requests []string // Remote address of each request
+		want     []bool
+	}{
+		{"whole app", RateLimitKeyApp, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, []bool{true, true, false}},
+		{"per ip", RateLimitKeyIP, []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.2"}, []bool{true, true, true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Refilling one token takes 1000s, so no tokens come back during the test
+			l, err := newRateLimit(&rateLimitRequest{Rate: 0.001, Burst: 2, Key: tt.key}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, addr := range tt.requests {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = addr + ":1234"
+				w := httptest.NewRecorder()
+				if got := l.Allow(w, r, ""); got != tt.want[i] {
+					t.Fatalf("request %d from %s allowed = %v, want %v", i, addr, got, tt.want[i])
+				}
+				if w.Header().Get("RateLimit-Limit") != "2" {
+					t.Errorf("RateLimit-Limit = %q", w.Header().Get("RateLimit-Limit"))
+				}
+				if retry := w.Header().Get("Retry-After"); tt.want[i] == (retry != "") {
+					t.Errorf("request %d has Retry-After %q", i, retry)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitBucketsAreCapped(t *testing.T) {
+	l, err := newRateLimit(&rateLimitRequest{Rate: 0.001, Burst: 1, Key: RateLimitKeyIP}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first key is used up, then kept in use while every other slot is filled
+	if ok, _, _ := l.take("first"); !ok {
+		t.Fatal("first request refused")
+	}
+	for i := 0; i < maxRateLimitBuckets-1; i++ {
+		l.take(strconv.Itoa(i))
+	}
+	if ok, _, _ := l.take("first"); ok {
+		t.Fatal("exhausted bucket allowed a request")
+	}
+
+	// Each new key evicts the least recently used bucket rather than growing the map
+	for i := 0; i < 10; i++ {
+		l.take("new" + strconv.Itoa(i))
+	}
+	if len(l.buckets) != maxRateLimitBuckets || l.lru.Len() != maxRateLimitBuckets {
+		t.Errorf("%d buckets, %d in the lru, want %d", len(l.buckets), l.lru.Len(), maxRateLimitBuckets)
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Error("least recently used bucket was not evicted")
+	}
+	if ok, _, _ := l.take("first"); ok {
+		t.Error("recently used bucket was evicted")
+	}
+}
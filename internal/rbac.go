@@ -0,0 +1,82 @@
+package internal
+
+// rbac.go
+// Roles for admin principals. Platform admins can manage every app, owners can create apps
+// and manage the apps they own, and viewers can read every app but change nothing
+import (
+	"errors"
+)
+
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleOwner  Role = "owner"
+	RoleViewer Role = "viewer"
+)
+
+// Parses a role name. An empty name is a viewer, so a token without a role can't change
+// anything unless it is given one explicitly
+func parseRole(name string) (Role, error) {
+	switch Role(name) {
+	case "":
+		return RoleViewer, nil
+	case RoleAdmin, RoleOwner, RoleViewer:
+		return Role(name), nil
+	default:
+		return "", errors.New("Unknown role: " + name)
+	}
+}
+
+// Indicates whether the principal can see the app's configuration
+func (p *Principal) CanRead(app *App) bool {
+	switch p.Role {
+	case RoleAdmin, RoleViewer:
+		return true
+	case RoleOwner:
+		return app.Owner == p.Name
+	default:
+		return false
+	}
+}
+
+// Indicates whether the principal can create apps
+func (p *Principal) CanCreate() bool {
+	return p.Role == RoleAdmin || p.Role == RoleOwner
+}
+
+// Indicates whether the principal can update or delete the app
+func (p *Principal) CanWrite(app *App) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleOwner:
+		return app.Owner == p.Name
+	default:
+		return false
+	}
+}
+
+// Indicates whether the principal can see the secret's metadata. Values are never returned
+func (p *Principal) CanReadSecret(secret *SecretMetadata) bool {
+	switch p.Role {
+	case RoleAdmin, RoleViewer:
+		return true
+	case RoleOwner:
+		return secret.Owner == p.Name
+	default:
+		return false
+	}
+}
+
+// Indicates whether the principal can rotate or delete the secret, or reference it from an app
+func (p *Principal) CanWriteSecret(secret *SecretMetadata) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleOwner:
+		return secret.Owner == p.Name
+	default:
+		return false
+	}
+}
@@ -9,6 +9,8 @@ import (
 // request should be handled by the given handler function
 // For a limited number of routes, this should be efficient enough
 type RegexMux struct {
+	server   []*route
+	hosts    []*hostRoute
 	routes   []*route
 	NotFound http.Handler
 }
@@ -19,6 +21,17 @@ type route struct {
 	handler http.Handler
 }
 
+// HostMatcher decides whether a request for the given Host header should be handled by a host route
+type HostMatcher interface {
+	MatchHost(host string) bool
+}
+
+// A host route is checked before any path routes, so a matched host owns every path under it
+type hostRoute struct {
+	matcher HostMatcher
+	handler http.Handler
+}
+
 type httpHandler struct {
 	handler func(w http.ResponseWriter, r *http.Request)
 }
@@ -37,7 +50,34 @@ func (mux *RegexMux) HandleFunc(pattern string, handler func(w http.ResponseWrit
 	mux.routes = append(mux.routes, &route{re, httpHandler{handler}})
 }
 
+// HandleServer registers a route of the server itself, such as an admin route. These are
+// checked after host routes, so an app's hostname keeps every path, and before path routes.
+// Host matchers must not match the server's own hostnames, which keeps these reachable there
+func (mux *RegexMux) HandleServer(pattern string, handler http.Handler) {
+	re := regexp.MustCompile(pattern)
+	mux.server = append(mux.server, &route{re, handler})
+}
+
+func (mux *RegexMux) HandleHost(matcher HostMatcher, handler http.Handler) {
+	mux.hosts = append(mux.hosts, &hostRoute{matcher, handler})
+}
+
 func (mux *RegexMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests for a matched host are handled regardless of the path
+	for _, host := range mux.hosts {
+		if host.matcher.MatchHost(r.Host) {
+			host.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	for _, route := range mux.server {
+		if route.pattern.MatchString(r.URL.Path) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
 	// Call the handler which matches the pattern
 	for _, route := range mux.routes {
 		if route.pattern.MatchString(r.URL.Path) {
@@ -0,0 +1,257 @@
+package internal
+
+// secrets.go
+// Encrypted store for secret values used in app environments. Each value is encrypted with
+// AES-256-GCM using the server's key, with the secret's name as additional data so that
+// values can't be swapped between entries in the file. Values are only decrypted when a
+// container is created, and are never returned by the API or written to logs
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errSecretsDisabled = errors.New("Secrets are not configured on this server")
+	errSecretNotFound  = errors.New("Secret not found")
+	secretNamePattern  = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+)
+
+// SecretMetadata is everything about a secret except its value, and is safe to return from the API
+type SecretMetadata struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Version   int       `json:"version"` // Incremented each time the value is rotated
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type storedSecret struct {
+	SecretMetadata
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SecretStore keeps encrypted secrets in a json file
+type SecretStore struct {
+	file    string
+	aead    cipher.AEAD
+	mu      sync.Mutex
+	secrets map[string]*storedSecret
+}
+
+// Parses a 32 byte key, encoded as hex or base64
+func parseSecretsKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if b, err := hex.DecodeString(key); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(key); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("Secrets key must be 32 bytes, encoded as hex or base64")
+}
+
+// Opens the secret store. Without a key the store is disabled, and every operation fails
+func NewSecretStore(file, key string) (*SecretStore, error) {
+	s := &SecretStore{
+		file:    file,
+		secrets: make(map[string]*storedSecret),
+	}
+	if key == "" {
+		return s, nil
+	}
+
+	k, err := parseSecretsKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	s.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.secrets); err != nil {
+		return nil, err
+	}
+
+	// Make sure the key matches the file, rather than failing later when an app starts
+	for name, secret := range s.secrets {
+		if _, err := s.aead.Open(nil, secret.Nonce, secret.Ciphertext, []byte(name)); err != nil {
+			return nil, errors.New("Could not decrypt secret " + name + ", the secrets key may be wrong")
+		}
+	}
+
+	return s, nil
+}
+
+func (s *SecretStore) Enabled() bool {
+	return s.aead != nil
+}
+
+// Writes every secret to a temporary file and renames it, so a crash never leaves a partial file
+func (s *SecretStore) save() error {
+	b, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Put creates the secret or rotates its value. The owner is only set on creation
+func (s *SecretStore) Put(name, owner, value string) (*SecretMetadata, error) {
+	if !s.Enabled() {
+		return nil, errSecretsDisabled
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	secret, ok := s.secrets[name]
+	if !ok {
+		secret = &storedSecret{SecretMetadata: SecretMetadata{Name: name, Owner: owner, CreatedAt: now}}
+	}
+
+	previous := *secret
+	secret.Version++
+	secret.UpdatedAt = now
+	secret.Nonce = nonce
+	secret.Ciphertext = s.aead.Seal(nil, nonce, []byte(value), []byte(name))
+	s.secrets[name] = secret
+
+	if err := s.save(); err != nil {
+		if ok {
+			*secret = previous
+		} else {
+			delete(s.secrets, name)
+		}
+		return nil, err
+	}
+
+	meta := secret.SecretMetadata
+	return &meta, nil
+}
+
+// Get returns the metadata of a secret
+func (s *SecretStore) Get(name string) (*SecretMetadata, error) {
+	if !s.Enabled() {
+		return nil, errSecretsDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, errSecretNotFound
+	}
+	meta := secret.SecretMetadata
+	return &meta, nil
+}
+
+// List returns the metadata of every secret
+func (s *SecretStore) List() ([]*SecretMetadata, error) {
+	if !s.Enabled() {
+		return nil, errSecretsDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*SecretMetadata, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		meta := secret.SecretMetadata
+		list = append(list, &meta)
+	}
+	return list, nil
+}
+
+// Delete removes the secret. Apps referencing it will fail to start until it is created again
+func (s *SecretStore) Delete(name string) error {
+	if !s.Enabled() {
+		return errSecretsDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return errSecretNotFound
+	}
+	delete(s.secrets, name)
+	if err := s.save(); err != nil {
+		s.secrets[name] = secret
+		return err
+	}
+	return nil
+}
+
+// reveal decrypts the value of a secret. Only used when creating containers
+func (s *SecretStore) reveal(name string) (string, error) {
+	if !s.Enabled() {
+		return "", errSecretsDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return "", errors.New("Secret not found: " + name)
+	}
+	b, err := s.aead.Open(nil, secret.Nonce, secret.Ciphertext, []byte(name))
+	if err != nil {
+		return "", errors.New("Could not decrypt secret: " + name)
+	}
+	return string(b), nil
+}
+
+// Builds KEY=value environment variables for the secrets referenced by an app
+func (s *SecretStore) environment(refs map[string]string) ([]string, error) {
+	env := make([]string, 0, len(refs))
+	for key, name := range refs {
+		value, err := s.reveal(name)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
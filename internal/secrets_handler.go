@@ -0,0 +1,161 @@
+// secrets_handler.go
+// Admin routes for managing secrets. Secrets are created and rotated by POSTing a value,
+// and only their metadata can be read back. Apps reference secrets by name in the
+// "secrets" field of their configuration
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type SecretsHandler struct{}
+
+func (h SecretsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal, ok := adminPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if !G.Secrets.Enabled() {
+		ErrorResponse(w, errSecretsDisabled.Error(), 503)
+		return
+	}
+
+	name, err := trimPath("/admin/secrets/", r)
+	if err != nil || name == "" {
+		if r.Method != "GET" {
+			ErrorResponse(w, "HTTP Method not supported", 400)
+			return
+		}
+		h.list(w, principal)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		h.get(w, principal, name)
+	case "POST":
+		G.Audit.audit(w, r, secretAuditTarget("secret.put", name), func(w http.ResponseWriter, r *http.Request) {
+			h.post(w, r, principal, name)
+		})
+	case "DELETE":
+		G.Audit.audit(w, r, secretAuditTarget("secret.delete", name), func(w http.ResponseWriter, r *http.Request) {
+			h.delete(w, principal, name)
+		})
+	default:
+		ErrorResponse(w, "HTTP Method not supported", 400)
+	}
+}
+
+// Audit target for a mutating request on a secret. Only metadata is compared, and the
+// request body is never recorded since it holds the value
+func secretAuditTarget(action, name string) auditTarget {
+	return auditTarget{
+		action: action,
+		secret: name,
+		snapshot: func() interface{} {
+			secret, _ := G.Secrets.Get(name)
+			return secret
+		},
+	}
+}
+
+// Lists the metadata of every secret visible to the caller, sorted by name
+func (SecretsHandler) list(w http.ResponseWriter, principal *Principal) {
+	secrets, err := G.Secrets.List()
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, err.Error(), 500)
+		return
+	}
+
+	visible := make([]*SecretMetadata, 0, len(secrets))
+	for _, secret := range secrets {
+		if principal.CanReadSecret(secret) {
+			visible = append(visible, secret)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].Name < visible[j].Name })
+
+	writeJSON(w, visible)
+}
+
+func (SecretsHandler) get(w http.ResponseWriter, principal *Principal, name string) {
+	secret, err := G.Secrets.Get(name)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 404)
+		return
+	}
+	if !principal.CanReadSecret(secret) {
+		ErrorResponse(w, "Not allowed to view this secret", 403)
+		return
+	}
+	writeJSON(w, secret)
+}
+
+type secretPostRequest struct {
+	Value string `json:"value"`
+}
+
+// Creates the secret, or rotates its value if it already exists. Running apps keep the
+// previous value until their container is created again
+func (SecretsHandler) post(w http.ResponseWriter, r *http.Request, principal *Principal, name string) {
+	if !secretNamePattern.MatchString(name) {
+		ErrorResponse(w, "Invalid secret name", 400)
+		return
+	}
+
+	if existing, err := G.Secrets.Get(name); err == nil {
+		if !principal.CanWriteSecret(existing) {
+			ErrorResponse(w, "Not allowed to modify this secret", 403)
+			return
+		}
+	} else if !principal.CanCreate() {
+		ErrorResponse(w, "Not allowed to create secrets", 403)
+		return
+	}
+
+	reqBody := &secretPostRequest{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(reqBody); err != nil {
+		ErrorResponse(w, "Could not parse request body", 400)
+		return
+	}
+	if reqBody.Value == "" {
+		ErrorResponse(w, "A value is required", 400)
+		return
+	}
+
+	secret, err := G.Secrets.Put(name, principal.Name, reqBody.Value)
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, "Could not save secret", 500)
+		return
+	}
+
+	G.Logger.Info("Secret " + name + " saved by " + principal.Name)
+	writeJSON(w, secret)
+}
+
+func (SecretsHandler) delete(w http.ResponseWriter, principal *Principal, name string) {
+	secret, err := G.Secrets.Get(name)
+	if err != nil {
+		ErrorResponse(w, err.Error(), 404)
+		return
+	}
+	if !principal.CanWriteSecret(secret) {
+		ErrorResponse(w, "Not allowed to delete this secret", 403)
+		return
+	}
+
+	if err := G.Secrets.Delete(name); err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, "Could not delete secret", 500)
+		return
+	}
+
+	G.Logger.Info("Secret " + name + " deleted by " + principal.Name)
+	w.WriteHeader(200)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testSecretsKey = strings.Repeat("ab", 32)
+
+func TestParseSecretsKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 32)
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"hex", testSecretsKey, false},
+		{"base64", base64.StdEncoding.EncodeToString(raw), false},
+		{"surrounding whitespace", " " + testSecretsKey + "\n", false},
+		{"short", strings.Repeat("ab", 16), true},
+		{"not encoded", strings.Repeat("z", 32), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseSecretsKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(key) != 32 {
+				t.Errorf("key has %d bytes, want 32", len(key))
+			}
+		})
+	}
+}
+
+func TestSecretStoreRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.json")
+	s, err := NewSecretStore(file, testSecretsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Put("db", "alice", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Put("db", "bob", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 2 || meta.Owner != "alice" {
+		t.Errorf("rotated secret has version %d and owner %q, want 2 and alice", meta.Version, meta.Owner)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("correct horse")) || bytes.Contains(b, []byte("hunter2")) {
+		t.Error("secret value stored in plain text")
+	}
+
+	// The value survives a restart with the same key
+	reopened, err := NewSecretStore(file, testSecretsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.reveal("db"); err != nil || got != "correct horse" {
+		t.Errorf("reveal = %q, %v", got, err)
+	}
+	env, err := reopened.environment(map[string]string{"DB_PASSWORD": "db"})
+	if err != nil || len(env) != 1 || env[0] != "DB_PASSWORD=correct horse" {
+		t.Errorf("environment = %q, %v", env, err)
+	}
+
+	if _, err := NewSecretStore(file, strings.Repeat("cd", 32)); err == nil {
+		t.Error("store opened with the wrong key")
+	}
+}
+
+func TestSecretStoreRejectsSwappedValues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.json")
+	s, err := NewSecretStore(file, testSecretsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"public": "not secret", "private": "very secret"} {
+		if _, err := s.Put(name, "alice", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each value is bound to its name, so moving it to another entry fails to decrypt
+	public, private := s.secrets["public"], s.secrets["private"]
+	public.Nonce, private.Nonce = private.Nonce, public.Nonce
+	public.Ciphertext, private.Ciphertext = private.Ciphertext, public.Ciphertext
+	if got, err := s.reveal("public"); err == nil {
+		t.Errorf("swapped value revealed as %q", got)
+	}
+
+	// The same holds for a file edited on disk, which is caught when the store is opened
+	b, err := json.Marshal(s.secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSecretStore(file, testSecretsKey); err == nil {
+		t.Error("store opened with swapped values")
+	}
+}
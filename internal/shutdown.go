@@ -0,0 +1,118 @@
+package internal
+
+// shutdown.go
+// Graceful shutdown of the server. Once shutdown begins, the listeners are closed and new
+// requests to apps are refused, while requests already being proxied are given until the
+// drain deadline to finish. h2c connections are hijacked from the http.Server, so its own
+// Shutdown can't see requests on them and they are tracked here instead.
+// Afterwards every runner's jobs are stopped, and the apps are either removed along with
+// their ingress configuration or left running for the next server. Listeners of the go
+// ingress are drained until the same deadline
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// requestTracker counts the requests currently being proxied to apps
+type requestTracker struct {
+	mu       sync.Mutex
+	count    int
+	draining bool
+	drained  chan struct{}
+}
+
+var inflight = &requestTracker{drained: make(chan struct{})}
+
+// Registers a new request. Returns false if the server is shutting down and the request must be refused
+func (t *requestTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.count++
+	return true
+}
+
+func (t *requestTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count--
+	if t.draining && t.count == 0 {
+		close(t.drained)
+	}
+}
+
+// Refuses new requests and waits until every request in flight is done or the context expires
+func (t *requestTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.draining {
+		t.draining = true
+		if t.count == 0 {
+			close(t.drained)
+		}
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the servers from accepting connections, drains requests in flight until the
+// context expires, and then stops every app. Apps are left running if G.KeepContainers is set
+func Shutdown(ctx context.Context, servers ...*http.Server) error {
+	var drainErr error
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			drainErr = err
+		}
+	}
+
+	if err := inflight.drain(ctx); err != nil {
+		G.Logger.Warning("Requests were still in flight when the drain deadline passed")
+		drainErr = err
+	}
+
+	ingressMu.Lock()
+	removed := false
+	var drains []func(context.Context) error
+	for _, app := range G.AppMgr.List() {
+		if G.KeepContainers {
+			app.Runner.StopJobs()
+			continue
+		}
+
+		if err := app.Runner.Cleanup(); err != nil {
+			G.Logger.LogError(err)
+		}
+		drain, err := closeAppIngress(appIngress(app), app)
+		if err != nil {
+			G.Logger.LogError(err)
+		}
+		drains = append(drains, drain)
+		G.AppMgr.Delete(app.ID)
+		removed = true
+	}
+
+	if removed {
+		if err := G.Ingress.Reload(); err != nil {
+			G.Logger.LogError(err)
+		}
+	}
+	ingressMu.Unlock()
+
+	// The listeners of every app are closed already, so they all drain until the same deadline
+	for _, drain := range drains {
+		if err := drain(ctx); err != nil && drainErr == nil {
+			drainErr = err
+		}
+	}
+
+	return drainErr
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cleanupRunner records when its app is cleaned up, among the other events of a test
+type cleanupRunner struct {
+	fakeRunner
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *cleanupRunner) record(event string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, event)
+}
+
+func (c *cleanupRunner) Cleanup() error {
+	c.record("cleanup")
+	return nil
+}
+
+// Replaces the request tracker for the duration of the test
+func testTracker(t *testing.T) *requestTracker {
+	prev := inflight
+	t.Cleanup(func() { inflight = prev })
+	inflight = &requestTracker{drained: make(chan struct{})}
+	return inflight
+}
+
+func TestRequestTracker(t *testing.T) {
+	tracker := &requestTracker{drained: make(chan struct{})}
+	if !tracker.start() {
+		t.Fatal("request refused before draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tracker.drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("drain with a request in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if tracker.start() {
+		t.Error("new request accepted while draining")
+	}
+
+	tracker.done()
+	if err := tracker.drain(context.Background()); err != nil {
+		t.Errorf("drain after the last request = %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		finish     bool // Whether the request in flight finishes before the deadline
+		wantErr    error
+		wantEvents string
+	}{
+		{"request finishes", true, nil, "request done, cleanup"},
+		{"deadline passes", false, context.DeadlineExceeded, "cleanup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &cleanupRunner{}
+			app := &App{ID: "app", Runner: runner}
+			g := testGlobal(t, app)
+			g.Ingress = NoIngress{}
+			tracker := testTracker(t)
+
+			if !tracker.start() {
+				t.Fatal("request refused")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- Shutdown(ctx) }()
+
+			// Apps are only cleaned up once the requests in flight are drained
+			time.Sleep(100 * time.Millisecond)
+			if tt.finish {
+				runner.record("request done")
+				tracker.done()
+			}
+
+			if err := <-done; err != tt.wantErr {
+				t.Errorf("Shutdown = %v, want %v", err, tt.wantErr)
+			}
+			if got := strings.Join(runner.events, ", "); got != tt.wantEvents {
+				t.Errorf("events = %q, want %q", got, tt.wantEvents)
+			}
+			if _, ok := G.AppMgr.Get(app.ID); ok {
+				t.Error("app still registered after Shutdown")
+			}
+			if tracker.start() {
+				t.Error("request accepted after Shutdown")
+			}
+		})
+	}
+}
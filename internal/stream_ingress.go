@@ -0,0 +1,397 @@
+package internal
+
+// stream_ingress.go
+// StreamIngress serves apps speaking raw tcp or udp, which no HTTP ingress can route. Each app
+// gets a port from its own range, and the server proxies bytes between the port and the
+// container. The first connection wakes an evicted container just like an HTTP request does,
+// and open connections count as invocations, so an app isn't stopped while it is in use.
+// UDP has no connections, so each client address is a session which ends after a period
+// without datagrams in either direction. Streams have no request boundaries, so an open
+// connection or session doesn't hold up a graceful shutdown; it is closed along with its app
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	streamDialTimeout   = 10 * time.Second
+	streamTouchInterval = time.Minute // How often open connections count as an invocation
+	udpSessionTimeout   = time.Minute
+	udpSessionQueue     = 64 // Datagrams queued for a session while its app wakes up
+
+	// Sessions per udp listener. Each holds a socket and goroutines, so datagrams from new
+	// clients are dropped past this, rather than letting spoofed addresses exhaust the server
+	defaultUDPMaxSessions = 1024
+)
+
+type StreamIngress struct {
+	Host     string // Host used in the external URLs of apps
+	BindHost string // Host the sockets bind to, the host of -addr
+
+	ports          *portAllocator
+	udpMaxSessions int
+	mu             sync.Mutex
+	listeners      map[string]*streamListener
+}
+
+// streamListener is the socket of an app along with the connections proxied through it
+type streamListener struct {
+	socket io.Closer // net.Listener for tcp, net.PacketConn for udp
+	url    string
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+}
+
+func NewStreamIngress(host, bindHost string, minPort, maxPort int) *StreamIngress {
+	return &StreamIngress{
+		Host:           host,
+		BindHost:       bindHost,
+		ports:          newPortAllocator(minPort, maxPort),
+		udpMaxSessions: defaultUDPMaxSessions,
+		listeners:      make(map[string]*streamListener),
+	}
+}
+
+// Opens the app's socket, unless it already has one, and returns its URL
+func (s *StreamIngress) Write(app *App) (string, error) {
+	if !isStream(app.Protocol) {
+		return "", errors.New("Only tcp and udp apps are served by the stream proxy")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.listeners[app.ID]; ok {
+		return l.url, nil
+	}
+
+	port, ok := s.ports.reserve(app.ID)
+	if !ok {
+		return "", errors.New("Out of stream ports")
+	}
+
+	l := &streamListener{
+		url:   app.Protocol + "://" + net.JoinHostPort(s.Host, strconv.Itoa(port)),
+		done:  make(chan struct{}),
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	// Listen before returning, so the app is reachable as soon as it is created
+	addr := net.JoinHostPort(s.BindHost, strconv.Itoa(port))
+	if app.Protocol == ProtocolUDP {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			s.ports.release(app.ID)
+			return "", err
+		}
+		l.socket = pc
+		go l.serveUDP(app.ID, pc, s.udpMaxSessions)
+	} else {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.ports.release(app.ID)
+			return "", err
+		}
+		l.socket = ln
+		go l.serveTCP(app.ID, ln)
+	}
+
+	s.listeners[app.ID] = l
+	return l.url, nil
+}
+
+// Closes the app's socket and every connection proxied through it, and frees its port
+func (s *StreamIngress) Remove(app *App) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.listeners[app.ID]
+	if !ok {
+		return nil
+	}
+	delete(s.listeners, app.ID)
+	s.ports.release(app.ID)
+	return l.close()
+}
+
+// Sockets are opened and closed by Write and Remove, so there is nothing to reload
+func (*StreamIngress) Reload() error { return nil }
+
+func (l *streamListener) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	return l.socket.Close()
+}
+
+// Registers a connection so it is closed along with the listener. Returns false if the
+// listener is already closed
+func (l *streamListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *streamListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+}
+
+func (l *streamListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Wakes the app and connects to it. Returns nil if the app is gone or can't be reached, after logging why
+func (l *streamListener) dialApp(id, network string) net.Conn {
+	app, ok := G.AppMgr.Get(id)
+	if !ok {
+		return nil
+	}
+	if err := wakeApp(app); err != nil {
+		G.Logger.LogError(err)
+		return nil
+	}
+
+	upstream, err := net.DialTimeout(network, app.Runner.Addr(), streamDialTimeout)
+	if err != nil {
+		G.Logger.Error("Could not reach app " + id + ": " + err.Error())
+		return nil
+	}
+	if !l.track(upstream) {
+		_ = upstream.Close()
+		return nil
+	}
+	return upstream
+}
+
+// Counts the app as invoked until stop is called, which records a last invocation before returning
+func keepAppAwake(id string) (stop func()) {
+	touch := func() {
+		if app, ok := G.AppMgr.Get(id); ok {
+			touchApp(app)
+		}
+	}
+	touch()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(streamTouchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				touch()
+			case <-done:
+				touch()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (l *streamListener) serveTCP(id string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			// Errors such as running out of file descriptors are temporary, so keep accepting
+			G.Logger.LogError(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.proxyTCP(id, conn)
+	}
+}
+
+func (l *streamListener) proxyTCP(id string, conn net.Conn) {
+	defer conn.Close()
+	if !l.track(conn) {
+		return
+	}
+	defer l.untrack(conn)
+
+	// Only waking and dialing the app counts as a request in flight, since an idle client would
+	// otherwise hold up shutdown until the drain deadline
+	if !inflight.start() {
+		return
+	}
+	upstream := l.dialApp(id, "tcp")
+	inflight.done()
+	if upstream == nil {
+		return
+	}
+	defer l.untrack(upstream)
+	defer upstream.Close()
+
+	stop := keepAppAwake(id)
+	defer stop()
+
+	start := time.Now()
+	done := make(chan struct{}, 2)
+	go func() {
+		copyAndCloseWrite(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		copyAndCloseWrite(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	G.Logger.Info(conn.RemoteAddr().String() + " tcp " + id + " " + strconv.Itoa(int(time.Since(start).Milliseconds())) + "ms")
+}
+
+// Copies until src is done, then passes the end of the stream on to dst
+func copyAndCloseWrite(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
+
+func (l *streamListener) serveUDP(id string, pc net.PacketConn, maxSessions int) {
+	var mu sync.Mutex
+	sessions := make(map[string]chan []byte)
+	full := false // Whether the session limit was reported since sessions were last available
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			G.Logger.LogError(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+
+		key := client.String()
+		mu.Lock()
+		queue, ok := sessions[key]
+		if !ok && len(sessions) >= maxSessions {
+			if !full {
+				G.Logger.Warning("App " + id + " has " + strconv.Itoa(maxSessions) + " udp sessions, dropping datagrams from new clients")
+				full = true
+			}
+			mu.Unlock()
+			continue
+		}
+		if !ok {
+			full = false
+			queue = make(chan []byte, udpSessionQueue)
+			sessions[key] = queue
+			go func() {
+				l.proxyUDP(id, pc, client, queue)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		// Datagrams may be dropped anyway, so a session which can't keep up loses them
+		select {
+		case queue <- datagram:
+		default:
+		}
+	}
+}
+
+// Proxies the datagrams of one client until the session is idle or the listener is closed
+func (l *streamListener) proxyUDP(id string, pc net.PacketConn, client net.Addr, queue chan []byte) {
+	// Like tcp connections, an idle session doesn't hold up shutdown
+	if !inflight.start() {
+		return
+	}
+	upstream := l.dialApp(id, "udp")
+	inflight.done()
+	if upstream == nil {
+		return
+	}
+	defer l.untrack(upstream)
+	defer upstream.Close()
+
+	stop := keepAppAwake(id)
+	defer stop()
+
+	// Replies are read until the upstream socket is closed when the session ends
+	replied := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := upstream.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// The app refused an earlier datagram, such as before it was listening
+				continue
+			}
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], client)
+			select {
+			case replied <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	idle := time.NewTimer(udpSessionTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case datagram := <-queue:
+			if _, err := upstream.Write(datagram); err != nil && l.isClosed() {
+				return
+			}
+		case <-replied:
+		case <-idle.C:
+			return
+		case <-l.done:
+			return
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(udpSessionTimeout)
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoRunner is an app whose service is an echo server
+type echoRunner struct {
+	fakeRunner
+	addr string
+}
+
+func (e *echoRunner) Addr() string { return e.addr }
+
+func tcpEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func udpEcho(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// Sends msg and returns the reply, or an error if none arrives in time
+func roundTrip(conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+// Removes the app and waits until every connection proxied for it is closed
+func removeStream(t *testing.T, s *StreamIngress, app *App) {
+	s.mu.Lock()
+	l := s.listeners[app.ID]
+	s.mu.Unlock()
+	if err := s.Remove(app); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		open := len(l.conns)
+		l.mu.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still open after Remove", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamIngressTCP(t *testing.T) {
+	app := &App{ID: "echo", Protocol: ProtocolTCP, Runner: &echoRunner{addr: tcpEcho(t)}}
+	testGlobal(t, app)
+
+	port := freePort(t)
+	s := NewStreamIngress("example.com", "127.0.0.1", port, port)
+	url, err := s.Write(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(url, "tcp://example.com:") {
+		t.Errorf("url = %q", url)
+	}
+	addr := s.listeners[app.ID].socket.(net.Listener).Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("listening on %v, want the bind host", addr)
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{"hello", "again"} {
+		if got, err := roundTrip(conn, msg, 5*time.Second); err != nil || got != msg {
+			t.Fatalf("echo of %q = %q, %v", msg, got, err)
+		}
+	}
+
+	// An open connection isn't a request in flight, so an idle client doesn't hold up shutdown
+	inflight.mu.Lock()
+	count := inflight.count
+	inflight.mu.Unlock()
+	if count != 0 {
+		t.Errorf("requests in flight with an idle connection = %d, want 0", count)
+	}
+
+	// Removing the app closes its connections
+	removeStream(t, s, app)
+	if _, err := roundTrip(conn, "closed", 5*time.Second); err == nil {
+		t.Error("connection still proxied after Remove")
+	}
+}
+
+func TestStreamIngressUDP(t *testing.T) {
+	app := &App{ID: "echo", Protocol: ProtocolUDP, Runner: &echoRunner{addr: udpEcho(t)}}
+	testGlobal(t, app)
+
+	port := freePort(t)
+	s := NewStreamIngress("example.com", "127.0.0.1", port, port)
+	s.udpMaxSessions = 1
+	if _, err := s.Write(app); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[app.ID].socket.(net.PacketConn).LocalAddr().String()
+
+	first, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if got, err := roundTrip(first, "ping", 5*time.Second); err != nil || got != "ping" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+
+	// A new client past the session limit is dropped
+	second, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if got, err := roundTrip(second, "ping", 200*time.Millisecond); err == nil {
+		t.Errorf("client past the session limit got %q", got)
+	}
+
+	// The existing session is still served
+	if got, err := roundTrip(first, "pong", 5*time.Second); err != nil || got != "pong" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+
+	removeStream(t, s, app)
+}
@@ -0,0 +1,251 @@
+package internal
+
+// tls.go
+// TLS termination on the built-in server, so it can run without an nginx sidecar. The
+// default certificate comes from -tls-cert and -tls-key, and certificates for other names,
+// such as the custom domains of apps, are read from -tls-cert-dir as <name>.crt and
+// <name>.key. A wildcard certificate for *.example.test is stored as _.example.test.crt.
+// The certificate for each connection is chosen by SNI, and every file is re-read when it
+// changes so certificates can be renewed without a restart. Certificates may also be
+// obtained through ACME, see acme.go
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Names which may be looked up in the certificate directory. Anything else could escape it
+var certNamePattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// certPair is a certificate and key read from files. The certificate is only replaced when
+// the new files parse, so a renewal which writes one file before the other never breaks it
+type certPair struct {
+	cert    *watchedFile
+	key     *watchedFile
+	certPEM []byte
+	keyPEM  []byte
+	loaded  *tls.Certificate
+	names   atomic.Value // []string, DNS names of the loaded certificate, read without the lock
+}
+
+func newCertPair(certFile, keyFile string) *certPair {
+	return &certPair{
+		cert: &watchedFile{path: certFile},
+		key:  &watchedFile{path: keyFile},
+	}
+}
+
+// Returns the certificate, re-reading the files if either changed. The previous certificate
+// is returned along with any error
+func (p *certPair) current() (*tls.Certificate, error) {
+	certPEM, certChanged, err := p.cert.changed()
+	if err != nil {
+		return p.loaded, err
+	}
+	keyPEM, keyChanged, err := p.key.changed()
+	if err != nil {
+		return p.loaded, err
+	}
+	if certChanged {
+		p.certPEM = certPEM
+	}
+	if keyChanged {
+		p.keyPEM = keyPEM
+	}
+
+	if certChanged || keyChanged {
+		cert, err := tls.X509KeyPair(p.certPEM, p.keyPEM)
+		if err != nil {
+			return p.loaded, err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return p.loaded, err
+		}
+		cert.Leaf = leaf
+		p.loaded = &cert
+		p.names.Store(leaf.DNSNames)
+	}
+	return p.loaded, nil
+}
+
+// CertStore selects the certificate for each TLS connection
+type CertStore struct {
+	dir  string
+	acme *autocert.Manager
+
+	mu    sync.Mutex
+	def   *certPair
+	hosts map[string]*certPair
+}
+
+// Creates the store from a default certificate and key, a directory of certificates for
+// other names, and an ACME manager. Any of them may be empty, but the certificate and key
+// go together
+func NewCertStore(certFile, keyFile, dir string, acmeManager *autocert.Manager) (*CertStore, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("A TLS certificate and key must be given together")
+	}
+
+	s := &CertStore{
+		dir:   dir,
+		acme:  acmeManager,
+		hosts: make(map[string]*certPair),
+	}
+
+	if certFile != "" {
+		s.def = newCertPair(certFile, keyFile)
+		if _, err := s.def.current(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New("TLS certificate directory is not a directory: " + dir)
+		}
+	}
+
+	return s, nil
+}
+
+// Names in the default certificate, which belong to the server itself. Every request checks
+// them, so they are cached when the certificate is loaded rather than read from the files
+func (s *CertStore) defaultNames() []string {
+	if s == nil || s.def == nil {
+		return nil
+	}
+	names, _ := s.def.names.Load().([]string)
+	return names
+}
+
+// Indicates whether there are any certificates to serve
+func (s *CertStore) Enabled() bool {
+	return s.def != nil || s.dir != "" || s.acme != nil
+}
+
+// Returns the certificate for name from the certificate directory, if there is one.
+// Must be called with the lock held
+func (s *CertStore) fromDir(name string) *tls.Certificate {
+	if s.dir == "" || !certNamePattern.MatchString(name) {
+		return nil
+	}
+
+	pair, ok := s.hosts[name]
+	if !ok {
+		base := filepath.Join(s.dir, name)
+		if _, err := os.Stat(base + ".crt"); err != nil {
+			return nil
+		}
+		pair = newCertPair(base+".crt", base+".key")
+		s.hosts[name] = pair
+	}
+
+	cert, err := pair.current()
+	if err != nil {
+		if os.IsNotExist(err) {
+			delete(s.hosts, name)
+			return nil
+		}
+		G.Logger.LogError(err)
+	}
+	return cert
+}
+
+// GetCertificate returns the certificate for the server name sent by the client: an exact
+// match from the certificate directory, then one obtained through ACME, then a wildcard
+// match, then the default certificate
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	if name != "" {
+		if cert := s.lookup(name); cert != nil {
+			return cert, nil
+		}
+		// Not holding the lock, since issuing a certificate may take a while
+		if s.acme != nil && s.acme.HostPolicy(context.Background(), name) == nil {
+			cert, err := s.acme.GetCertificate(hello)
+			if err == nil {
+				return cert, nil
+			}
+			G.Logger.Warning("Could not get an ACME certificate for " + name + ": " + err.Error())
+		}
+		if i := strings.Index(name, "."); i > 0 {
+			if cert := s.lookup("_" + name[i:]); cert != nil {
+				return cert, nil
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.def != nil {
+		cert, err := s.def.current()
+		if err != nil {
+			G.Logger.LogError(err)
+		}
+		if cert != nil {
+			return cert, nil
+		}
+	}
+
+	return nil, errors.New("No certificate for " + name)
+}
+
+func (s *CertStore) lookup(name string) *tls.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fromDir(name)
+}
+
+// TLSConfig is the server TLS configuration using the store's certificates
+func (s *CertStore) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	// Lets the ACME manager answer TLS-ALPN-01 challenges as well, when the CA can reach this listener
+	if s.acme != nil {
+		config.NextProtos = []string{acme.ALPNProto}
+	}
+	return config
+}
+
+// RedirectHTTPS redirects every request to the same URL on the TLS address
+type RedirectHTTPS struct {
+	TLSAddr string
+}
+
+func (h RedirectHTTPS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if _, port, err := net.SplitHostPort(h.TLSAddr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// Only GET and HEAD may be redirected with a 301 without clients changing the method
+	status := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for the names to base.crt and base.key
+func writeTestCert(t *testing.T, base string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChanged(t, base+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeChanged(t, base+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// Writes the file with a modification time after any earlier write, so the change is seen
+// even on file systems with a coarse timestamp resolution
+func writeChanged(t *testing.T, file string, content []byte) {
+	modTime := time.Now()
+	if info, err := os.Stat(file); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Names of the certificate served for the server name, joined by commas
+func servedNames(t *testing.T, s *CertStore, serverName string) string {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(leaf.DNSNames, ",")
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	testGlobal(t)
+	dir := t.TempDir()
+	certDir := filepath.Join(dir, "certs")
+	if err := os.Mkdir(certDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, filepath.Join(dir, "default"), "server.example.com")
+	writeTestCert(t, filepath.Join(certDir, "app.example.com"), "app.example.com")
+	writeTestCert(t, filepath.Join(certDir, "_.apps.example.com"), "*.apps.example.com")
+	writeTestCert(t, filepath.Join(certDir, "shop.apps.example.com"), "shop.apps.example.com")
+
+	s, err := NewCertStore(filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), certDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+	}{
+		{"exact match", "app.example.com", "app.example.com"},
+		{"case and trailing dot", "App.Example.COM.", "app.example.com"},
+		{"wildcard", "blog.apps.example.com", "*.apps.example.com"},
+		{"exact match before wildcard", "shop.apps.example.com", "shop.apps.example.com"},
+		{"wildcard covers one label", "a.b.apps.example.com", "server.example.com"},
+		{"unknown name", "other.example.com", "server.example.com"},
+		{"no SNI", "", "server.example.com"},
+		{"path outside the directory", "../default", "server.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := servedNames(t, s, tt.serverName); got != tt.want {
+				t.Errorf("certificate for %q = %s, want %s", tt.serverName, got, tt.want)
+			}
+		})
+	}
+	if got := strings.Join(s.defaultNames(), ","); got != "server.example.com" {
+		t.Errorf("defaultNames = %s, want server.example.com", got)
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		writeTestCert(t, filepath.Join(certDir, "app.example.com"), "app.example.com", "renewed.example.com")
+		if got := servedNames(t, s, "app.example.com"); got != "app.example.com,renewed.example.com" {
+			t.Errorf("after renewal = %s", got)
+		}
+
+		// A renewal which has written the certificate but not yet its key keeps the old pair
+		writeTestCert(t, filepath.Join(dir, "next"), "next.example.com")
+		next, err := ioutil.ReadFile(filepath.Join(dir, "next.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeChanged(t, filepath.Join(certDir, "app.example.com.crt"), next)
+		if got := servedNames(t, s, "app.example.com"); got != "app.example.com,renewed.example.com" {
+			t.Errorf("with a mismatched key = %s", got)
+		}
+
+		// The default certificate's cached names follow its renewal
+		writeTestCert(t, filepath.Join(dir, "default"), "server.example.com", "admin.example.com")
+		if got := servedNames(t, s, ""); got != "server.example.com,admin.example.com" {
+			t.Errorf("default after renewal = %s", got)
+		}
+		if got := strings.Join(s.defaultNames(), ","); got != "server.example.com,admin.example.com" {
+			t.Errorf("defaultNames after renewal = %s", got)
+		}
+
+		// A removed certificate falls back to the wildcard
+		for _, ext := range []string{".crt", ".key"} {
+			if err := os.Remove(filepath.Join(certDir, "shop.apps.example.com"+ext)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := servedNames(t, s, "shop.apps.example.com"); got != "*.apps.example.com" {
+			t.Errorf("after removal = %s", got)
+		}
+	})
+}
+
+func TestCertStoreWithoutDefault(t *testing.T) {
+	testGlobal(t)
+	s, err := NewCertStore("", "", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedNames(t, s, "unknown.example.com"); !strings.HasPrefix(got, "error:") {
+		t.Errorf("certificate for an unknown name = %s, want an error", got)
+	}
+	if _, err := NewCertStore("server.crt", "", "", nil); err == nil {
+		t.Error("certificate accepted without a key")
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+// traefik_ingress.go
+// TraefikIngress writes a dynamic configuration file for each app into a directory watched by
+// Traefik's file provider. Each app gets a router matching <id>.<domain> and its custom domains,
+// which forwards to this server. Traefik picks up the files by itself, so there is nothing to
+// reload
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+type TraefikIngress struct {
+	Dir         string   // Directory watched by Traefik's file provider
+	Domain      string   // Apps are served at <id>.<Domain>
+	Upstream    string   // Address Traefik reaches this server at
+	EntryPoints []string // Entry points the routers are attached to. Empty means all of them
+
+	tmpl *ingressTemplate
+}
+
+const traefikTemplate = `http:
+  routers:
+    {{ .Name }}:
+      rule: {{ quote .Rule }}
+      service: {{ .Name }}
+      middlewares:
+        - {{ .Name }}-headers
+{{- if .EntryPoints }}
+      entryPoints:
+{{- range .EntryPoints }}
+        - {{ quote . }}
+{{- end }}
+{{- end }}
+  middlewares:
+    {{ .Name }}-headers:
+      headers:
+        customRequestHeaders:
+          X-Forwarded-Prefix: "/"
+  services:
+    {{ .Name }}:
+      loadBalancer:
+        passHostHeader: true
+        servers:
+          - url: {{ quote .Upstream }}
+`
+
+// Data available to the Traefik template, in addition to the common ingress template data
+type traefikTemplateData struct {
+	ingressTemplateData
+	Rule        string // Host rule matching the app's hosts
+	EntryPoints []string
+}
+
+// Creates the ingress, using the template file instead of the built-in template when one is given
+func NewTraefikIngress(dir, domain, upstream string, entryPoints []string, templateFile string) (*TraefikIngress, error) {
+	if dir == "" {
+		return nil, errors.New("The Traefik ingress requires a directory to write configuration to")
+	}
+	tmpl, err := newIngressTemplate("traefik", traefikTemplate, templateFile)
+	if err != nil {
+		return nil, err
+	}
+	return &TraefikIngress{
+		Dir:         dir,
+		Domain:      domain,
+		Upstream:    upstream,
+		EntryPoints: entryPoints,
+		tmpl:        tmpl,
+	}, nil
+}
+
+func (t *TraefikIngress) file(id string) string {
+	return path.Join(t.Dir, id+".yml")
+}
+
+// Writes the app's configuration file, returning the URL of its first host
+func (t *TraefikIngress) Write(app *App) (string, error) {
+	hosts := appHosts(app, t.Domain)
+	if len(hosts) == 0 {
+		return "", errors.New("The app needs a domain to be served by Traefik")
+	}
+
+	rules := make([]string, len(hosts))
+	for i, host := range hosts {
+		rules[i] = "Host(`" + host + "`)"
+	}
+
+	data := newIngressTemplateData(app, hosts, t.Upstream)
+	if data.HTTP2 {
+		// Traefik reaches gRPC apps over h2c, which the server accepts on its main address
+		data.Upstream = "h2c://" + t.Upstream
+	}
+
+	b, err := t.tmpl.execute(traefikTemplateData{
+		ingressTemplateData: data,
+		Rule:                strings.Join(rules, " || "),
+		EntryPoints:         t.EntryPoints,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Traefik only loads .yml files, so it never reads the temp file
+	if err := writeFileAtomic(t.file(app.ID), b, 0664); err != nil {
+		return "", err
+	}
+	return "http://" + hosts[0], nil
+}
+
+// Deletes the app's configuration file
+func (t *TraefikIngress) Remove(app *App) error {
+	if err := os.Remove(t.file(app.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Traefik watches the directory, so changes take effect as soon as they are written
+func (*TraefikIngress) Reload() error { return nil }
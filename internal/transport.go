@@ -0,0 +1,80 @@
+package internal
+
+// transport.go
+// Builds the http.RoundTripper used by an app's reverse proxy to reach its container.
+// Apps may speak plain HTTP/1.1, HTTP/2 over cleartext (h2c), or HTTP/2 over TLS.
+// The HTTP/2 variants are required for gRPC, which depends on HTTP/2 framing and trailers.
+// Apps speaking raw tcp or udp are reached through the stream proxy instead
+import (
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+)
+
+const (
+	ProtocolHTTP = "http" // HTTP/1.1 over cleartext, the default
+	ProtocolH2C  = "h2c"  // HTTP/2 over cleartext with prior knowledge, typical for gRPC
+	ProtocolH2   = "h2"   // HTTP/2 over TLS
+	ProtocolTCP  = "tcp"  // Raw TCP connections, served by the stream proxy
+	ProtocolUDP  = "udp"  // UDP datagrams, served by the stream proxy
+)
+
+// Returns the protocol to use for an app, or an error if the protocol is not supported.
+// An empty string selects the default HTTP/1.1 protocol
+func parseProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "":
+		return ProtocolHTTP, nil
+	case ProtocolHTTP, ProtocolH2C, ProtocolH2, ProtocolTCP, ProtocolUDP:
+		return protocol, nil
+	default:
+		return "", errors.New("Unsupported protocol: " + protocol)
+	}
+}
+
+// Indicates whether the protocol uses HTTP/2 between the proxy and the container
+func isHTTP2(protocol string) bool {
+	return protocol == ProtocolH2C || protocol == ProtocolH2
+}
+
+// Indicates whether the app is reached through the stream proxy instead of over HTTP
+func isStream(protocol string) bool {
+	return protocol == ProtocolTCP || protocol == ProtocolUDP
+}
+
+// URL scheme used by the reverse proxy to reach a container using this protocol.
+// Containers using mutual TLS are always reached over TLS
+func upstreamScheme(protocol string, mtls bool) string {
+	if protocol == ProtocolH2 || mtls {
+		return "https"
+	}
+	return "http"
+}
+
+// Creates a transport for the protocol. The tls config is used by h2 upstreams, and by
+// HTTP/1.1 upstreams when it isn't nil
+func newUpstreamTransport(protocol string, tlsConfig *tls.Config) http.RoundTripper {
+	switch protocol {
+	case ProtocolH2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			// h2c uses a plain TCP connection, but the http2 transport only knows how to dial TLS
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+	case ProtocolH2:
+		return &http2.Transport{
+			TLSClientConfig: tlsConfig,
+		}
+	default:
+		if tlsConfig == nil {
+			return http.DefaultTransport
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		return transport
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"time"
 )
 
 type basicResponse struct {
@@ -47,6 +48,18 @@ func newResponse(message string) []byte {
 	return b
 }
 
+// Writes v as a json response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		G.Logger.LogError(err)
+		ErrorResponse(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(b)
+}
+
 type NotFoundHandler struct{}
 
 // Default 404 handler
@@ -63,3 +76,23 @@ func trimPath(base string, r *http.Request) (string, error) {
 
 	return r.URL.Path[baseLen:], nil
 }
+
+// Duration is a time.Duration which is written to and read from json as a string like "1m30s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,28 @@
+#!/bin/sh
+
+# Creates an HMAC-signed admin token
+# usage: mint_admin_token.sh <key> <name> [lifetime in seconds] [role]
+# The role is always written into the token and defaults to admin here, since this creates admin
+# tokens. The server treats a token without a role as a viewer
+
+if [ $# -lt 2 ]; then
+    echo "usage: $0 <key> <name> [lifetime in seconds] [role]" >&2
+    exit 1
+fi
+
+KEY="$1"
+NAME="$2"
+EXP=0
+if [ -n "$3" ]; then
+    EXP=$(( $(date +%s) + $3 ))
+fi
+ROLE="${4:-admin}"
+
+b64url() {
+    openssl base64 -A | tr '+/' '-_' | tr -d '='
+}
+
+PAYLOAD=$(printf '{"sub":"%s","role":"%s","exp":%s}' "$NAME" "$ROLE" "$EXP" | b64url)
+SIGNATURE=$(printf 'v1.%s' "$PAYLOAD" | openssl dgst -sha256 -hmac "$KEY" -binary | b64url)
+
+printf 'v1.%s.%s\n' "$PAYLOAD" "$SIGNATURE"